@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/docker/docker/pkg/namesgenerator"
 	"github.com/onrik/logrus/filename"
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/statemachine"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
 
@@ -23,8 +27,36 @@ var (
 
 	createAgent        = app.Command("create-agent", "Create a new agent.")
 	createAgentTags    = createAgent.Flag("tag", "Assign a tag to the agent.").Short('t').Strings()
+	createAgentQueue   = createAgent.Flag("queue", "Assign the agent to a queue, this overrides the default queue.").Short('q').String()
+	createAgentJobs    = createAgent.Flag("max-concurrent-jobs", "The number of jobs the agent can run concurrently.").Short('j').Default("1").Int()
+	createAgentPri     = createAgent.Flag("priority", "The priority of the agent, agents with a higher priority are assigned jobs first.").Short('p').String()
+	createAgentKey     = createAgent.Flag("agent-key-param", "The SSM parameter holding the buildkite agent key used to register the agent, this overrides the default key.").Short('k').String()
 	createAgentProject = createAgent.Arg("project", "The name of the codebuild project.").Required().String()
+	disableAgent       = app.Command("disable-agent", "Disable an agent, this disconnects it from buildkite.")
+	disableAgentName   = disableAgent.Arg("name", "The name of the agent.").Required().String()
+	enableAgent        = app.Command("enable-agent", "Enable an agent, this registers it with buildkite, including agents disconnected by buildkite.")
+	enableAgentName    = enableAgent.Arg("name", "The name of the agent.").Required().String()
+	removeAgent        = app.Command("remove-agent", "Remove an agent, this disconnects it from buildkite then deletes it.")
+	removeAgentName    = removeAgent.Arg("name", "The name of the agent.").Required().String()
+	scaleAgent         = app.Command("scale-agent", "Set the number of jobs an agent can run concurrently.")
+	scaleAgentName     = scaleAgent.Arg("name", "The name of the agent.").Required().String()
+	scaleAgentJobs     = scaleAgent.Arg("max-concurrent-jobs", "The number of jobs the agent can run concurrently.").Required().Int()
+	priorityAgent      = app.Command("set-agent-priority", "Set the priority of an agent, this registers it again with buildkite.")
+	priorityAgentName  = priorityAgent.Arg("name", "The name of the agent.").Required().String()
+	priorityAgentPri   = priorityAgent.Arg("priority", "The priority of the agent, agents with a higher priority are assigned jobs first.").Required().String()
+	keyAgent           = app.Command("set-agent-key-param", "Set the SSM parameter holding the buildkite agent key of an agent, this registers it again with buildkite.")
+	keyAgentName       = keyAgent.Arg("name", "The name of the agent.").Required().String()
+	keyAgentParam      = keyAgent.Arg("agent-key-param", "The SSM parameter holding the buildkite agent key, an empty value uses the default key.").Required().String()
+	rotateAgent        = app.Command("rotate-agent-token", "Rotate the access token of an agent, jobs which are running keep the old token until they complete.")
+	rotateAgentName    = rotateAgent.Arg("name", "The name of the agent.").Required().String()
 	buildSpec          = app.Command("build-spec", "Create a buildspec json.")
+	findExecution      = app.Command("find-execution", "Find the codebuild job monitor execution for a buildkite job.")
+	findExecutionArn   = findExecution.Flag("state-machine-arn", "The arn of the codebuild job monitor state machine.").Envar("SFN_CODEBUILD_JOB_MONITOR_ARN").Required().String()
+	findExecutionJob   = findExecution.Arg("job-id", "The id of the buildkite job.").Required().String()
+	stateMachine       = app.Command("state-machine", "Create the codebuild job monitor state machine definition json, by default the lambda arns are substitutions used in deploy.sam.yml.")
+	stateMachineSubmit = stateMachine.Flag("submit-job-arn", "The arn of the submit job lambda.").Default("${SfnSubmitLambdaARN}").String()
+	stateMachineCheck  = stateMachine.Flag("check-job-arn", "The arn of the check job lambda.").Default("${SfnCheckLambdaARN}").String()
+	stateMachineDone   = stateMachine.Flag("complete-job-arn", "The arn of the complete job lambda.").Default("${SfnCompleteLambdaARN}").String()
 )
 
 func main() {
@@ -49,9 +81,12 @@ func main() {
 		logrus.WithField("agentName", agentName).Info("Agent name assigned")
 
 		agentRecord := &store.AgentRecord{
-			Name:             agentName,
-			Tags:             updateTags(*createAgentTags),
-			CodebuildProject: *createAgentProject,
+			Name:              agentName,
+			Tags:              agentTags(*createAgentTags, *createAgentQueue),
+			CodebuildProject:  *createAgentProject,
+			MaxConcurrentJobs: *createAgentJobs,
+			Priority:          agentPriority(*createAgentPri),
+			AgentKeyParam:     *createAgentKey,
 		}
 
 		agentRecord, err := agentStore.CreateOrUpdate(agentRecord)
@@ -60,6 +95,34 @@ func main() {
 		}
 
 		logrus.WithField("agent", agentRecord).Info("created")
+	case disableAgent.FullCommand():
+		updateAgent(agentStore, *disableAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.Disabled = true
+		})
+	case enableAgent.FullCommand():
+		updateAgent(agentStore, *enableAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.Enable()
+		})
+	case removeAgent.FullCommand():
+		updateAgent(agentStore, *removeAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.Removed = true
+		})
+	case scaleAgent.FullCommand():
+		updateAgent(agentStore, *scaleAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.MaxConcurrentJobs = *scaleAgentJobs
+		})
+	case priorityAgent.FullCommand():
+		updateAgent(agentStore, *priorityAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.Priority = agentPriority(*priorityAgentPri)
+		})
+	case keyAgent.FullCommand():
+		updateAgent(agentStore, *keyAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.AgentKeyParam = *keyAgentParam
+		})
+	case rotateAgent.FullCommand():
+		updateAgent(agentStore, *rotateAgentName, func(agentRecord *store.AgentRecord) {
+			agentRecord.RotateTokensBefore = time.Now()
+		})
 	case buildSpec.FullCommand():
 
 		jsonSpec := map[string]string{
@@ -72,18 +135,88 @@ func main() {
 		}
 
 		fmt.Println(string(data))
+	case findExecution.FullCommand():
+
+		cfg.SfnCodebuildJobMonitorArn = *findExecutionArn
+
+		executor := statemachine.NewSFNExecutor(cfg, session.Must(session.NewSession()))
+
+		execution, err := executor.FindByJobID(*findExecutionJob)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to find execution")
+		}
+
+		if execution == nil {
+			logrus.WithField("ID", *findExecutionJob).Fatal("no execution found for job")
+		}
+
+		fmt.Println(aws.StringValue(execution.ExecutionArn), aws.StringValue(execution.Status), aws.TimeValue(execution.StartDate).Format(time.RFC3339))
+	case stateMachine.FullCommand():
+
+		definition := statemachine.NewJobMonitorDefinition(&statemachine.JobMonitorResources{
+			SubmitJobArn:   *stateMachineSubmit,
+			CheckJobArn:    *stateMachineCheck,
+			CompleteJobArn: *stateMachineDone,
+		})
+
+		err := definition.Validate()
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid state machine definition")
+		}
+
+		data, err := json.MarshalIndent(definition, "", "  ")
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create json")
+		}
+
+		fmt.Println(string(data))
+	}
+}
+
+// updateAgent apply a change to the agent, the agent pool completes the change on its next run
+func updateAgent(agentStore store.AgentsAPI, name string, update func(*store.AgentRecord)) {
+
+	// the agent is written conditionally so changes made by the agent pool at the same time aren't lost
+	agentRecord, err := agentStore.Update(name, func(agentRecord *store.AgentRecord) error {
+		update(agentRecord)
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to update agent")
+	}
+
+	logrus.WithField("agent", agentRecord).Info("updated")
+}
+
+// agentPriority validate the priority is a number, buildkite sends it as a string
+func agentPriority(priority string) string {
+
+	if priority == "" {
+		return priority
+	}
+
+	_, err := strconv.Atoi(priority)
+	if err != nil {
+		logrus.WithError(err).Fatal("priority must be a number")
 	}
+
+	return priority
 }
 
-func updateTags(tags []string) []string {
+func agentTags(tags []string, queue string) []string {
+
+	if queue == "" {
+		return tags
+	}
 
 	resTags := []string{}
 
+	// the queue flag replaces any queue passed in as a tag
 	for _, tag := range tags {
 		if !strings.HasPrefix(tag, "queue=") {
 			resTags = append(resTags, tag)
 		}
 	}
 
-	return resTags
+	return append(resTags, fmt.Sprintf("queue=%s", queue))
 }
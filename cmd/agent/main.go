@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/onrik/logrus/filename"
@@ -12,6 +14,8 @@ import (
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/handlers"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/ssmcache"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/statemachine"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
 
 func main() {
@@ -31,22 +35,59 @@ func main() {
 
 	sess := session.Must(session.NewSession())
 
+	// calls which are safe to repeat are retried, the others fail fast
+	buildkiteAPI := bk.NewRetryAPI(bk.NewAgentAPI(cfg), bk.DefaultRetryPolicy)
+
+	// executions can be passed a reference to the job which the step handlers load from the workflow store
+	workflowStore := store.NewWorkflows(cfg)
+
 	switch cfg.LambdaHandler {
 	case "agent-poll":
-		agentPool := agentpool.New(cfg, sess, bk.NewAgentAPI())
+		agentPool := agentpool.New(cfg, sess, buildkiteAPI)
 
 		bkw := agentpool.NewBuildkiteWorker(agentPool)
 
 		lambda.Start(bkw.Handler)
 	case "submit-job":
-		sh := handlers.NewSubmitJobHandler(cfg, bk.NewAgentAPI())
-		lambda.Start(sh.HandlerSubmitJob)
+		sh := handlers.NewSubmitJobHandler(cfg, sess, buildkiteAPI)
+		lambda.Start(handlers.WithStepErrors(handlers.WithWorkflowStore(workflowStore, sh.HandlerSubmitJob)))
 	case "check-job":
-		bkw := handlers.NewCheckJobHandler(cfg, sess, bk.NewAgentAPI())
-		lambda.Start(bkw.HandlerCheckJob)
+		bkw := handlers.NewCheckJobHandler(cfg, sess, buildkiteAPI)
+		lambda.Start(handlers.WithStepErrors(handlers.WithWorkflowStore(workflowStore, bkw.HandlerCheckJob)))
 	case "complete-job":
-		bkw := handlers.NewCompletedJobHandler(cfg, sess, bk.NewAgentAPI())
-		lambda.Start(bkw.HandlerCompletedJob)
+		bkw := handlers.NewCompletedJobHandler(cfg, sess, buildkiteAPI)
+		lambda.Start(handlers.WithStepErrors(handlers.WithWorkflowStore(workflowStore, bkw.HandlerCompletedJob)))
+	case "local":
+		// run the step handlers in this process rather than step functions, this is used for development
+		sh := handlers.NewSubmitJobHandler(cfg, sess, buildkiteAPI)
+		ch := handlers.NewCheckJobHandler(cfg, sess, buildkiteAPI)
+		cjh := handlers.NewCompletedJobHandler(cfg, sess, buildkiteAPI)
+
+		executor := statemachine.NewLocalExecutor(&statemachine.LocalTasks{
+			SubmitJob:   statemachine.Task(handlers.WithWorkflowStore(workflowStore, sh.HandlerSubmitJob)),
+			CheckJob:    statemachine.Task(handlers.WithWorkflowStore(workflowStore, ch.HandlerCheckJob)),
+			CompleteJob: statemachine.Task(handlers.WithWorkflowStore(workflowStore, cjh.HandlerCompletedJob)),
+		}, cfg.LocalWaitTime)
+
+		agentPool := agentpool.NewWithExecutor(cfg, buildkiteAPI, executor)
+
+		bkw := agentpool.NewBuildkiteWorker(agentPool)
+
+		// poll the agents each minute, as the scheduled agent poller lambda does
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+			err := bkw.Handler(ctx, &events.CloudWatchEvent{})
+			if err != nil {
+				log.WithError(err).Error("failed to poll agents")
+			}
+
+			<-ctx.Done()
+			cancel()
+		}
+	case "reconcile-jobs":
+		rh := handlers.NewReconcileJobsHandler(cfg, sess)
+		lambda.Start(rh.HandlerReconcileJobs)
 	default:
 		log.WithField("LambdaHandler", cfg.LambdaHandler).Fatal("failed to locate job handler")
 	}
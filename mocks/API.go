@@ -3,7 +3,6 @@
 package mocks
 
 import api "github.com/buildkite/agent/api"
-
 import mock "github.com/stretchr/testify/mock"
 
 // API is an autogenerated mock type for the API type
@@ -12,11 +11,11 @@ type API struct {
 }
 
 // AcceptJob provides a mock function with given fields: _a0, _a1
-func (_m *API) AcceptJob(_a0 string, _a1 *api.Job) (*api.Job, error) {
+func (_m *API) AcceptJob(_a0 *api.Agent, _a1 *api.Job) (*api.Job, error) {
 	ret := _m.Called(_a0, _a1)
 
 	var r0 *api.Job
-	if rf, ok := ret.Get(0).(func(string, *api.Job) *api.Job); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent, *api.Job) *api.Job); ok {
 		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
@@ -25,7 +24,7 @@ func (_m *API) AcceptJob(_a0 string, _a1 *api.Job) (*api.Job, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, *api.Job) error); ok {
+	if rf, ok := ret.Get(1).(func(*api.Agent, *api.Job) error); ok {
 		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
@@ -35,11 +34,11 @@ func (_m *API) AcceptJob(_a0 string, _a1 *api.Job) (*api.Job, error) {
 }
 
 // Beat provides a mock function with given fields: _a0
-func (_m *API) Beat(_a0 string) (*api.Heartbeat, error) {
+func (_m *API) Beat(_a0 *api.Agent) (*api.Heartbeat, error) {
 	ret := _m.Called(_a0)
 
 	var r0 *api.Heartbeat
-	if rf, ok := ret.Get(0).(func(string) *api.Heartbeat); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent) *api.Heartbeat); ok {
 		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
@@ -48,7 +47,7 @@ func (_m *API) Beat(_a0 string) (*api.Heartbeat, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
+	if rf, ok := ret.Get(1).(func(*api.Agent) error); ok {
 		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
@@ -58,11 +57,11 @@ func (_m *API) Beat(_a0 string) (*api.Heartbeat, error) {
 }
 
 // ChunksUpload provides a mock function with given fields: _a0, _a1, _a2
-func (_m *API) ChunksUpload(_a0 string, _a1 string, _a2 *api.Chunk) error {
+func (_m *API) ChunksUpload(_a0 *api.Agent, _a1 string, _a2 *api.Chunk) error {
 	ret := _m.Called(_a0, _a1, _a2)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, *api.Chunk) error); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, *api.Chunk) error); ok {
 		r0 = rf(_a0, _a1, _a2)
 	} else {
 		r0 = ret.Error(0)
@@ -71,13 +70,27 @@ func (_m *API) ChunksUpload(_a0 string, _a1 string, _a2 *api.Chunk) error {
 	return r0
 }
 
-// FinishJob provides a mock function with given fields: _a0, _a1
-func (_m *API) FinishJob(_a0 string, _a1 *api.Job) error {
-	ret := _m.Called(_a0, _a1)
+// Connect provides a mock function with given fields: _a0
+func (_m *API) Connect(_a0 *api.Agent) error {
+	ret := _m.Called(_a0)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, *api.Job) error); ok {
-		r0 = rf(_a0, _a1)
+	if rf, ok := ret.Get(0).(func(*api.Agent) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CreateAnnotation provides a mock function with given fields: _a0, _a1, _a2
+func (_m *API) CreateAnnotation(_a0 *api.Agent, _a1 string, _a2 *api.Annotation) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, *api.Annotation) error); ok {
+		r0 = rf(_a0, _a1, _a2)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -85,12 +98,84 @@ func (_m *API) FinishJob(_a0 string, _a1 *api.Job) error {
 	return r0
 }
 
+// CreateArtifacts provides a mock function with given fields: _a0, _a1, _a2
+func (_m *API) CreateArtifacts(_a0 *api.Agent, _a1 string, _a2 *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 *api.ArtifactBatchCreateResponse
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, *api.ArtifactBatch) *api.ArtifactBatchCreateResponse); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*api.ArtifactBatchCreateResponse)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*api.Agent, string, *api.ArtifactBatch) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Disconnect provides a mock function with given fields: _a0
+func (_m *API) Disconnect(_a0 *api.Agent) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*api.Agent) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// FinishJob provides a mock function with given fields: _a0, _a1, _a2
+func (_m *API) FinishJob(_a0 *api.Agent, _a1 *api.Job, _a2 string) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*api.Agent, *api.Job, string) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetMetaData provides a mock function with given fields: _a0, _a1, _a2
+func (_m *API) GetMetaData(_a0 *api.Agent, _a1 string, _a2 string) (string, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, string) string); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*api.Agent, string, string) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetStateJob provides a mock function with given fields: _a0, _a1
-func (_m *API) GetStateJob(_a0 string, _a1 string) (*api.JobState, error) {
+func (_m *API) GetStateJob(_a0 *api.Agent, _a1 string) (*api.JobState, error) {
 	ret := _m.Called(_a0, _a1)
 
 	var r0 *api.JobState
-	if rf, ok := ret.Get(0).(func(string, string) *api.JobState); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent, string) *api.JobState); ok {
 		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
@@ -99,7 +184,7 @@ func (_m *API) GetStateJob(_a0 string, _a1 string) (*api.JobState, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+	if rf, ok := ret.Get(1).(func(*api.Agent, string) error); ok {
 		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
@@ -109,11 +194,11 @@ func (_m *API) GetStateJob(_a0 string, _a1 string) (*api.JobState, error) {
 }
 
 // Ping provides a mock function with given fields: _a0
-func (_m *API) Ping(_a0 string) (*api.Ping, error) {
+func (_m *API) Ping(_a0 *api.Agent) (*api.Ping, error) {
 	ret := _m.Called(_a0)
 
 	var r0 *api.Ping
-	if rf, ok := ret.Get(0).(func(string) *api.Ping); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent) *api.Ping); ok {
 		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
@@ -122,7 +207,7 @@ func (_m *API) Ping(_a0 string) (*api.Ping, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
+	if rf, ok := ret.Get(1).(func(*api.Agent) error); ok {
 		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
@@ -131,13 +216,13 @@ func (_m *API) Ping(_a0 string) (*api.Ping, error) {
 	return r0, r1
 }
 
-// Register provides a mock function with given fields: _a0, _a1, _a2
-func (_m *API) Register(_a0 string, _a1 string, _a2 []string) (*api.Agent, error) {
-	ret := _m.Called(_a0, _a1, _a2)
+// Register provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *API) Register(_a0 string, _a1 string, _a2 []string, _a3 string) (*api.Agent, error) {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
 
 	var r0 *api.Agent
-	if rf, ok := ret.Get(0).(func(string, string, []string) *api.Agent); ok {
-		r0 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(0).(func(string, string, []string, string) *api.Agent); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*api.Agent)
@@ -145,8 +230,8 @@ func (_m *API) Register(_a0 string, _a1 string, _a2 []string) (*api.Agent, error
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string, []string) error); ok {
-		r1 = rf(_a0, _a1, _a2)
+	if rf, ok := ret.Get(1).(func(string, string, []string, string) error); ok {
+		r1 = rf(_a0, _a1, _a2, _a3)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -154,12 +239,26 @@ func (_m *API) Register(_a0 string, _a1 string, _a2 []string) (*api.Agent, error
 	return r0, r1
 }
 
+// SetMetaData provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *API) SetMetaData(_a0 *api.Agent, _a1 string, _a2 string, _a3 string) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, string, string) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // StartJob provides a mock function with given fields: _a0, _a1
-func (_m *API) StartJob(_a0 string, _a1 *api.Job) error {
+func (_m *API) StartJob(_a0 *api.Agent, _a1 *api.Job) error {
 	ret := _m.Called(_a0, _a1)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, *api.Job) error); ok {
+	if rf, ok := ret.Get(0).(func(*api.Agent, *api.Job) error); ok {
 		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Error(0)
@@ -167,3 +266,17 @@ func (_m *API) StartJob(_a0 string, _a1 *api.Job) error {
 
 	return r0
 }
+
+// UpdateArtifacts provides a mock function with given fields: _a0, _a1, _a2
+func (_m *API) UpdateArtifacts(_a0 *api.Agent, _a1 string, _a2 map[string]string) error {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*api.Agent, string, map[string]string) error); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
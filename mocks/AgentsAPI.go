@@ -12,6 +12,34 @@ type AgentsAPI struct {
 	mock.Mock
 }
 
+// AddRunningJob provides a mock function with given fields: job
+func (_m *AgentsAPI) AddRunningJob(job *store.RunningJob) error {
+	ret := _m.Called(job)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*store.RunningJob) error); ok {
+		r0 = rf(job)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Create provides a mock function with given fields: agent
+func (_m *AgentsAPI) Create(agent *store.AgentRecord) error {
+	ret := _m.Called(agent)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*store.AgentRecord) error); ok {
+		r0 = rf(agent)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CreateOrUpdate provides a mock function with given fields: agent
 func (_m *AgentsAPI) CreateOrUpdate(agent *store.AgentRecord) (*store.AgentRecord, error) {
 	ret := _m.Called(agent)
@@ -35,6 +63,34 @@ func (_m *AgentsAPI) CreateOrUpdate(agent *store.AgentRecord) (*store.AgentRecor
 	return r0, r1
 }
 
+// Delete provides a mock function with given fields: name
+func (_m *AgentsAPI) Delete(name string) error {
+	ret := _m.Called(name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteLock provides a mock function with given fields: name
+func (_m *AgentsAPI) DeleteLock(name string) error {
+	ret := _m.Called(name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Get provides a mock function with given fields: name
 func (_m *AgentsAPI) Get(name string) (*store.AgentRecord, error) {
 	ret := _m.Called(name)
@@ -58,6 +114,29 @@ func (_m *AgentsAPI) Get(name string) (*store.AgentRecord, error) {
 	return r0, r1
 }
 
+// GetRunningJob provides a mock function with given fields: agentName, jobID
+func (_m *AgentsAPI) GetRunningJob(agentName string, jobID string) (*store.RunningJob, error) {
+	ret := _m.Called(agentName, jobID)
+
+	var r0 *store.RunningJob
+	if rf, ok := ret.Get(0).(func(string, string) *store.RunningJob); ok {
+		r0 = rf(agentName, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*store.RunningJob)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(agentName, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // List provides a mock function with given fields:
 func (_m *AgentsAPI) List() ([]*store.AgentRecord, error) {
 	ret := _m.Called()
@@ -81,6 +160,29 @@ func (_m *AgentsAPI) List() ([]*store.AgentRecord, error) {
 	return r0, r1
 }
 
+// ListRunningJobs provides a mock function with given fields: agentName
+func (_m *AgentsAPI) ListRunningJobs(agentName string) ([]*store.RunningJob, error) {
+	ret := _m.Called(agentName)
+
+	var r0 []*store.RunningJob
+	if rf, ok := ret.Get(0).(func(string) []*store.RunningJob); ok {
+		r0 = rf(agentName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*store.RunningJob)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(agentName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // NewLock provides a mock function with given fields: name, ttl
 func (_m *AgentsAPI) NewLock(name string, ttl time.Duration) (dynalock.Locker, error) {
 	ret := _m.Called(name, ttl)
@@ -103,3 +205,40 @@ func (_m *AgentsAPI) NewLock(name string, ttl time.Duration) (dynalock.Locker, e
 
 	return r0, r1
 }
+
+// RemoveRunningJob provides a mock function with given fields: agentName, jobID
+func (_m *AgentsAPI) RemoveRunningJob(agentName string, jobID string) error {
+	ret := _m.Called(agentName, jobID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(agentName, jobID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Update provides a mock function with given fields: name, update
+func (_m *AgentsAPI) Update(name string, update func(*store.AgentRecord) error) (*store.AgentRecord, error) {
+	ret := _m.Called(name, update)
+
+	var r0 *store.AgentRecord
+	if rf, ok := ret.Get(0).(func(string, func(*store.AgentRecord) error) *store.AgentRecord); ok {
+		r0 = rf(name, update)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*store.AgentRecord)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, func(*store.AgentRecord) error) error); ok {
+		r1 = rf(name, update)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -4,12 +4,80 @@ package mocks
 
 import api "github.com/buildkite/agent/api"
 import mock "github.com/stretchr/testify/mock"
+import sfn "github.com/aws/aws-sdk-go/service/sfn"
 
 // Executor is an autogenerated mock type for the Executor type
 type Executor struct {
 	mock.Mock
 }
 
+// FindByJobID provides a mock function with given fields: jobID
+func (_m *Executor) FindByJobID(jobID string) (*sfn.ExecutionListItem, error) {
+	ret := _m.Called(jobID)
+
+	var r0 *sfn.ExecutionListItem
+	if rf, ok := ret.Get(0).(func(string) *sfn.ExecutionListItem); ok {
+		r0 = rf(jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*sfn.ExecutionListItem)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetExecutionData provides a mock function with given fields: executionArn
+func (_m *Executor) GetExecutionData(executionArn string) ([]byte, error) {
+	ret := _m.Called(executionArn)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func(string) []byte); ok {
+		r0 = rf(executionArn)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(executionArn)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReconcileRunning provides a mock function with given fields:
+func (_m *Executor) ReconcileRunning() (int, error) {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // RunningForAgent provides a mock function with given fields: agentName
 func (_m *Executor) RunningForAgent(agentName string) (int, error) {
 	ret := _m.Called(agentName)
@@ -44,3 +112,17 @@ func (_m *Executor) StartExecution(agentName string, job *api.Job, jsonData []by
 
 	return r0
 }
+
+// StopExecution provides a mock function with given fields: executionArn, cause
+func (_m *Executor) StopExecution(executionArn string, cause string) error {
+	ret := _m.Called(executionArn, cause)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(executionArn, cause)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
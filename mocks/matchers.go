@@ -0,0 +1,13 @@
+package mocks
+
+import (
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/mock"
+)
+
+// AccessToken match the agent config passed to the buildkite api using the access token
+func AccessToken(token string) interface{} {
+	return mock.MatchedBy(func(agentConfig *api.Agent) bool {
+		return agentConfig.AccessToken == token
+	})
+}
@@ -12,6 +12,7 @@ import (
 type AgentInstance struct {
 	cfg   *config.Config
 	agent *store.AgentRecord
+	lock  *agentLock // held while this poller owns the agent
 }
 
 // NewAgentInstance create a new agent instance
@@ -42,14 +43,14 @@ func (ai *AgentInstance) ConfigKey() string {
 	return fmt.Sprintf("/%s/%s/%s", ai.EnvironmentName(), ai.EnvironmentNumber(), ai.Name())
 }
 
-// Tags return the tags for the agent instance
+// CodebuildProject return the codebuild project for the agent instance
 func (ai *AgentInstance) CodebuildProject() string {
 	return ai.agent.CodebuildProject
 }
 
-// Tags return the tags for the agent instance
+// Tags return the tags for the agent instance, these are the stored tags merged with the pool defaults
 func (ai *AgentInstance) Tags() []string {
-	return ai.agent.Tags
+	return mergeTags(defaultTags(ai.cfg), ai.agent.Tags)
 }
 
 // AgentConfig return the config for the agent instance
@@ -0,0 +1,103 @@
+package agentpool
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/dynalock"
+)
+
+// lockTTLPadding added to the lambda deadline to cover cleanup of the agents
+const lockTTLPadding = 5 * time.Second
+
+// how long to wait for an agent lock before skipping the agent, this allows for a slow conditional write but is
+// shorter than the 3 second dynalock retry interval so only one attempt is made to acquire a lock which is held elsewhere
+var lockAcquireTimeout = 2500 * time.Millisecond
+
+// how long to wait for an agent lock to be released
+var lockReleaseTimeout = 5 * time.Second
+
+// agentLock a lease held on an agent by this poller which is renewed in the background until it is released
+type agentLock struct {
+	locker   dynalock.Locker
+	stopCh   chan struct{}
+	lockHeld <-chan struct{}
+}
+
+type lockResult struct {
+	lockHeld <-chan struct{}
+	err      error
+}
+
+// acquireLock try to acquire the lock, this returns nil if the lock is held elsewhere. If the lock is acquired as the
+// attempt is cancelled it can't be unlocked, as the lease stops renewing, so it is removed using deleteLock.
+func acquireLock(locker dynalock.Locker, deleteLock func() error) (*agentLock, error) {
+
+	stopCh := make(chan struct{})
+	resultCh := make(chan *lockResult, 1)
+
+	go func() {
+		lockHeld, err := locker.Lock(stopCh)
+		resultCh <- &lockResult{lockHeld: lockHeld, err: err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			close(stopCh)
+			return nil, errors.Wrap(res.err, "failed to acquire lock")
+		}
+
+		return &agentLock{locker: locker, stopCh: stopCh, lockHeld: res.lockHeld}, nil
+	case <-time.After(lockAcquireTimeout):
+		close(stopCh)
+
+		res := <-resultCh
+		if res.err != nil {
+			return nil, nil
+		}
+
+		// the lock was acquired while cancelling, wait for the lease to stop renewing before removing it so it isn't
+		// written again, otherwise no poller can use the agent until the lease expires
+		<-res.lockHeld
+
+		err := deleteLock()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to remove abandoned lock")
+		}
+
+		return nil, nil
+	}
+}
+
+// Held is the lock still held, this is false once the lease fails to renew
+func (al *agentLock) Held() bool {
+	select {
+	case <-al.lockHeld:
+		return false
+	default:
+		return true
+	}
+}
+
+// Release stop renewing the lease and release the lock
+func (al *agentLock) Release() error {
+	defer close(al.stopCh)
+
+	if !al.Held() {
+		return nil
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- al.locker.Unlock()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(lockReleaseTimeout):
+		return errors.New("timed out releasing lock")
+	}
+}
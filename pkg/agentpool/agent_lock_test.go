@@ -0,0 +1,122 @@
+package agentpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/dynalock"
+)
+
+// fakeLocker simulates a dynalock lock which is either free or held elsewhere
+type fakeLocker struct {
+	heldElsewhere bool
+	slow          time.Duration // acquire the lock after this regardless of the attempt being cancelled
+	err           error
+	lockHeld      chan struct{}
+	unlocked      bool
+}
+
+func newFakeLocker() *fakeLocker {
+	return &fakeLocker{lockHeld: make(chan struct{})}
+}
+
+func (fl *fakeLocker) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	if fl.err != nil {
+		return nil, fl.err
+	}
+
+	if fl.heldElsewhere {
+		<-stopChan
+		return nil, dynalock.ErrLockAcquireCancelled
+	}
+
+	if fl.slow > 0 {
+		time.Sleep(fl.slow)
+
+		// the lease stops renewing once the stop channel is closed
+		go func() {
+			<-stopChan
+			close(fl.lockHeld)
+		}()
+	}
+
+	return fl.lockHeld, nil
+}
+
+func (fl *fakeLocker) Unlock() error {
+	fl.unlocked = true
+	return nil
+}
+
+func Test_acquireLock(t *testing.T) {
+
+	defer func(timeout time.Duration) { lockAcquireTimeout = timeout }(lockAcquireTimeout)
+	lockAcquireTimeout = 10 * time.Millisecond
+
+	deleted := false
+	deleteLock := func() error {
+		deleted = true
+		return nil
+	}
+
+	locker := newFakeLocker()
+
+	lock, err := acquireLock(locker, deleteLock)
+	require.Nil(t, err)
+	require.NotNil(t, lock)
+	require.True(t, lock.Held())
+
+	require.Nil(t, lock.Release())
+	require.True(t, locker.unlocked)
+
+	lock, err = acquireLock(&fakeLocker{heldElsewhere: true}, deleteLock)
+	require.Nil(t, err)
+	require.Nil(t, lock)
+	require.False(t, deleted)
+
+	_, err = acquireLock(&fakeLocker{err: errors.New("whoops")}, deleteLock)
+	require.Error(t, err)
+	require.False(t, deleted)
+}
+
+func Test_acquireLock_AcquiredWhileCancelling(t *testing.T) {
+
+	defer func(timeout time.Duration) { lockAcquireTimeout = timeout }(lockAcquireTimeout)
+	lockAcquireTimeout = 10 * time.Millisecond
+
+	locker := newFakeLocker()
+	locker.slow = 50 * time.Millisecond
+
+	deleted := false
+
+	lock, err := acquireLock(locker, func() error {
+		deleted = true
+		return nil
+	})
+	require.Nil(t, err)
+	require.Nil(t, lock)
+	require.True(t, deleted)
+
+	locker = newFakeLocker()
+	locker.slow = 50 * time.Millisecond
+
+	_, err = acquireLock(locker, func() error { return errors.New("whoops") })
+	require.EqualError(t, err, "failed to remove abandoned lock: whoops")
+}
+
+func Test_agentLock_Held(t *testing.T) {
+
+	locker := newFakeLocker()
+
+	lock, err := acquireLock(locker, func() error { return nil })
+	require.Nil(t, err)
+
+	// renewal of the lease failed
+	close(locker.lockHeld)
+
+	require.False(t, lock.Held())
+	require.Nil(t, lock.Release())
+	require.False(t, locker.unlocked)
+}
@@ -6,13 +6,16 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/buildkite/agent/api"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/cancel"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/params"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/statemachine"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
+	"github.com/wolfeidau/dynalock"
 )
 
 // DefaultAgentNamePrefix serverless agent name prefix used when registering the agent
@@ -21,43 +24,66 @@ const DefaultAgentNamePrefix = "serverless-agent"
 // DefaultAgentPoolSize default agent size if one is not specified
 const DefaultAgentPoolSize = 5
 
+const (
+	pingActionPause      = "pause"
+	pingActionDisconnect = "disconnect"
+)
+
 // ActionFunc async agent action function
 type ActionFunc func(agentInstance *AgentInstance, resultsChan chan *AgentResult)
 
 // AgentResult agent result from operation
 type AgentResult struct {
-	Name  string // name of the agent which returned the result
-	Error error
+	Name         string // name of the agent which returned the result
+	Error        error
+	Polled       bool          // the agent was polled and can accept jobs
+	Action       string        // action returned by the buildkite ping
+	PingInterval time.Duration // ping interval assigned by buildkite when the agent was registered
+	JobAccepted  bool
+}
+
+// PollResult summary of a poll of all the agents in the pool
+type PollResult struct {
+	Polled       int           // number of agents which were polled and can accept jobs
+	JobsAccepted int           // number of jobs accepted across all the agents
+	PingInterval time.Duration // longest ping interval of the agents which were polled
 }
 
 // AgentPool used to store a pool of agents which are created on launch
 type AgentPool struct {
-	Agents       []*AgentInstance
-	cfg          *config.Config
-	buildkiteAPI bk.API
-	paramStore   params.Store
-	agentStore   store.AgentsAPI
-	executor     statemachine.Executor
+	Agents        []*AgentInstance
+	cfg           *config.Config
+	buildkiteAPI  bk.API
+	paramStore    params.Store
+	agentStore    store.AgentsAPI
+	workflowStore store.WorkflowStore
+	executor      statemachine.Executor
+	canceller     cancel.Canceller
 }
 
-// New create a new agent pool and populate it based on the poolsize
+// New create a new agent pool and populate it based on the poolsize, jobs are run using step functions
 func New(cfg *config.Config, sess *session.Session, buildkiteAPI bk.API) *AgentPool {
+	return NewWithExecutor(cfg, buildkiteAPI, statemachine.NewSFNExecutor(cfg, sess))
+}
 
-	executor := statemachine.NewSFNExecutor(cfg, sess)
+// NewWithExecutor create a new agent pool which runs jobs using the executor
+func NewWithExecutor(cfg *config.Config, buildkiteAPI bk.API, executor statemachine.Executor) *AgentPool {
 
 	paramStore := params.New(cfg)
 
 	return &AgentPool{
-		Agents:       []*AgentInstance{},
-		buildkiteAPI: buildkiteAPI,
-		cfg:          cfg,
-		agentStore:   store.NewAgents(cfg),
-		paramStore:   paramStore,
-		executor:     executor,
+		Agents:        []*AgentInstance{},
+		buildkiteAPI:  buildkiteAPI,
+		cfg:           cfg,
+		agentStore:    store.NewAgents(cfg),
+		workflowStore: store.NewWorkflows(cfg),
+		paramStore:    paramStore,
+		executor:      executor,
+		canceller:     cancel.NewJobCanceller(cfg, buildkiteAPI, executor),
 	}
 }
 
-// LoadAgents register all the agents in the pool
+// LoadAgents load all the agents in the pool, including a replica for each additional job an agent can run
 func (ap *AgentPool) LoadAgents() error {
 
 	agents, err := ap.agentStore.List()
@@ -67,14 +93,7 @@ func (ap *AgentPool) LoadAgents() error {
 
 	agentsIntances := []*AgentInstance{}
 
-	for _, agent := range agents {
-		agent.Tags = []string{
-			"aws",
-			"serverless",
-			"codebuild",
-			ap.cfg.AwsRegion,
-			fmt.Sprintf("queue=%s", ap.cfg.EnvironmentName),
-		}
+	for _, agent := range expandReplicas(agents) {
 		agentsIntances = append(agentsIntances, NewAgentInstance(ap.cfg, agent))
 	}
 
@@ -83,26 +102,52 @@ func (ap *AgentPool) LoadAgents() error {
 	return nil
 }
 
-// RegisterAgents register all the agents in the pool
+// RegisterAgents register all the agents in the pool, agents which are locked by another poller are skipped
 func (ap *AgentPool) RegisterAgents(deadline time.Time) error {
-	resultsChan := dispatchAgentTasks(ap.Agents, ap.asyncRegister)
-	return processResults(ap.Agents, deadline, resultsChan)
+	resultsChan := dispatchAgentTasks(ap.Agents, ap.asyncRegister(deadline))
+	_, err := processResults(ap.Agents, deadline, resultsChan)
+	return err
 }
 
-// PollAgents send a heartbeat to all the agents in the pool then check for jobs using ping
-func (ap *AgentPool) PollAgents(deadline time.Time) error {
-	resultsChan := dispatchAgentTasks(ap.Agents, ap.asyncPoll)
-	return processResults(ap.Agents, deadline, resultsChan)
+// PollAgents send a heartbeat to all the agents in the pool then check for jobs using ping, agents which are
+// locked by another poller are skipped
+func (ap *AgentPool) PollAgents(deadline time.Time) (*PollResult, error) {
+	resultsChan := dispatchAgentTasks(ap.Agents, ap.asyncPoll(deadline))
+
+	results, err := processResults(ap.Agents, deadline, resultsChan)
+
+	// summarise the agents which were polled even if some failed
+	pollResult := &PollResult{}
+
+	for _, result := range results {
+		if result.JobAccepted {
+			pollResult.JobsAccepted++
+		}
+
+		if !result.Polled {
+			continue
+		}
+
+		pollResult.Polled++
+
+		if result.PingInterval > pollResult.PingInterval {
+			pollResult.PingInterval = result.PingInterval
+		}
+	}
+
+	return pollResult, err
 }
 
-// CleanupAgents unlock agent name
+// CleanupAgents release the agent locks and disconnect any agents which have been disabled or removed
 func (ap *AgentPool) CleanupAgents(deadline time.Time) error {
 	resultsChan := dispatchAgentTasks(ap.Agents, ap.asyncCleanup)
-	return processResults(ap.Agents, deadline, resultsChan)
+	_, err := processResults(ap.Agents, deadline, resultsChan)
+	return err
 }
 
 func dispatchAgentTasks(agents []*AgentInstance, action ActionFunc) chan *AgentResult {
-	resultsChan := make(chan *AgentResult)
+	// buffered so agents which complete after a timeout don't block
+	resultsChan := make(chan *AgentResult, len(agents))
 
 	for _, agent := range agents {
 		go action(agent, resultsChan)
@@ -111,27 +156,54 @@ func dispatchAgentTasks(agents []*AgentInstance, action ActionFunc) chan *AgentR
 	return resultsChan
 }
 
-func processResults(agents []*AgentInstance, deadline time.Time, resultsChan chan *AgentResult) error {
+// processResults collect the results from all the agents, returning a PoolError naming each agent which
+// failed or didn't respond before the deadline
+func processResults(agents []*AgentInstance, deadline time.Time, resultsChan chan *AgentResult) ([]*AgentResult, error) {
 
 	timeoutChannel := time.After(time.Until(deadline))
 
+	results := []*AgentResult{}
+	responded := map[string]bool{}
+	poolErr := &PoolError{Errors: map[string]error{}}
+
+LOOP:
 	for range agents {
 		select {
 		case <-timeoutChannel:
-			return fmt.Errorf("timed out during API operation")
+			break LOOP
 		case result := <-resultsChan:
+			responded[result.Name] = true
+
 			if result.Error != nil {
-				return result.Error
+				log.WithError(result.Error).WithField("agentName", result.Name).Error("agent operation failed")
+				poolErr.Errors[result.Name] = result.Error
 			}
+
+			results = append(results, result)
 		}
 	}
 
-	return nil
+	for _, agent := range agents {
+		if !responded[agent.Name()] {
+			poolErr.Errors[agent.Name()] = fmt.Errorf("timed out during API operation")
+		}
+	}
+
+	if len(poolErr.Errors) > 0 {
+		return results, poolErr
+	}
 
+	return results, nil
 }
 
-func (ap *AgentPool) getAgentKey() (string, error) {
-	agentSSMKey := fmt.Sprintf("/%s/%s/buildkite-agent-key", ap.cfg.EnvironmentName, ap.cfg.EnvironmentNumber)
+// getAgentKey load the registration token for the agent, agents can name their own ssm parameter so they can be
+// registered with a different buildkite organisation or cluster, otherwise the stack wide key is used
+func (ap *AgentPool) getAgentKey(agent *store.AgentRecord) (string, error) {
+	agentSSMKey := agent.AgentKeyParam
+
+	if agentSSMKey == "" {
+		agentSSMKey = fmt.Sprintf("/%s/%s/buildkite-agent-key", ap.cfg.EnvironmentName, ap.cfg.EnvironmentNumber)
+	}
 
 	log.WithField("agentSSMKey", agentSSMKey).Info("Loading buildkite key from SSM")
 
@@ -143,62 +215,357 @@ func (ap *AgentPool) getAgentKey() (string, error) {
 	return agentKey, nil
 }
 
-func (ap *AgentPool) asyncRegister(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
-	resultsChan <- &AgentResult{Name: agentInstance.Name(), Error: ap.register(agentInstance)}
+func (ap *AgentPool) asyncRegister(deadline time.Time) ActionFunc {
+	return func(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
+		resultsChan <- &AgentResult{Name: agentInstance.Name(), Error: ap.register(agentInstance, deadline)}
+	}
+}
+
+// register register and connect the agent while holding the agent lock, so only one poller replaces the agent
+func (ap *AgentPool) register(agentInstance *AgentInstance, deadline time.Time) error {
+
+	agent := agentInstance.Agent()
+
+	// disabled or removed agents are disconnected during cleanup
+	if !agent.Active() {
+		log.WithField("agentName", agent.Name).Info("skipping registration of inactive agent")
+		return nil
+	}
+
+	// agents disconnected by buildkite stay disconnected until they are enabled again
+	if agent.State == store.AgentStateDisconnected {
+		log.WithField("agentName", agent.Name).Info("skipping registration of disconnected agent")
+		return nil
+	}
+
+	if !registrationRequired(agentInstance) && agent.Connected() {
+		return nil
+	}
+
+	locked, err := ap.lockAgent(agentInstance, deadline)
+	if err != nil {
+		return errors.Wrap(err, "failed to lock agent")
+	}
+
+	if !locked {
+		log.WithField("agentName", agent.Name).Info("skipping registration of agent locked by another poller")
+		return nil
+	}
+
+	// the registration was reloaded when the lock was acquired as another poller may have changed it
+	if agent.State == store.AgentStateDisconnected {
+		log.WithField("agentName", agent.Name).Info("skipping registration of disconnected agent")
+		return nil
+	}
+
+	if registrationRequired(agentInstance) {
+		err := ap.registerAgent(agentInstance, agentInstance.Tags())
+		if err != nil {
+			return err
+		}
+	}
+
+	if agent.Connected() {
+		return nil
+	}
+
+	err = ap.buildkiteAPI.Connect(agent.AgentConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect agent")
+	}
+
+	return ap.updateAgent(agent, func(agent *store.AgentRecord) {
+		agent.UpdateState(store.AgentStateConnected)
+	})
 }
 
-func (ap *AgentPool) register(agentInstance *AgentInstance) error {
+// registrationRequired the agent is registered if it is new or the tags, priority or agent key have changed since
+// it was registered
+func registrationRequired(agentInstance *AgentInstance) bool {
+
+	agent := agentInstance.Agent()
+
+	return agent.AgentConfig == nil || !tagsEqual(agent.RegisteredTags, agentInstance.Tags()) ||
+		agent.RegisteredPriority != agent.Priority || agent.RegisteredAgentKeyParam != agent.AgentKeyParam
+}
+
+func (ap *AgentPool) registerAgent(agentInstance *AgentInstance, tags []string) error {
+
+	agent := agentInstance.Agent()
 
 	// load the agents key
-	agentKey, err := ap.getAgentKey()
+	agentKey, err := ap.getAgentKey(agent)
 	if err != nil {
 		return errors.Wrap(err, "failed to get agent key from param store")
 	}
 
-	if agentInstance.AgentConfig() != nil {
-		return nil
+	// the tags, priority or access token have changed so retire the existing agent before it is replaced
+	err = ap.retireAgentConfig(agent)
+	if err != nil {
+		return err
 	}
 
+	log.WithField("agentName", agent.Name).WithField("tags", tags).WithField("priority", agent.Priority).Info("registering agent")
+
 	// register a new agent
-	agentConfig, err := ap.buildkiteAPI.Register(agentInstance.Name(), agentKey, agentInstance.Tags())
+	agentConfig, err := ap.buildkiteAPI.Register(agentInstance.Name(), agentKey, tags, agent.Priority)
 	if err != nil {
 		return errors.Wrap(err, "failed to register agent")
 	}
 
+	registered := time.Now()
+	previousAgentConfig := agent.PreviousAgentConfig
+	priority := agent.Priority
+	agentKeyParam := agent.AgentKeyParam
+
+	// only the registration is written so changes made with the agent-cli since the agent was loaded are kept
+	return ap.updateAgent(agent, func(agent *store.AgentRecord) {
+		agent.AgentConfig = agentConfig
+		agent.PreviousAgentConfig = previousAgentConfig
+		agent.Registered = registered
+		agent.RegisteredTags = tags
+		agent.RegisteredPriority = priority
+		agent.RegisteredAgentKeyParam = agentKeyParam
+		agent.UpdateState(store.AgentStateRegistered)
+	})
+}
+
+// retireAgentConfig disconnect the existing agent before it is replaced, if it accepted a job which is still running
+// it is kept as the previous agent config until the job completes as the job uses its access token
+func (ap *AgentPool) retireAgentConfig(agent *store.AgentRecord) error {
+
+	if agent.AgentConfig == nil {
+		return nil
+	}
+
+	count, err := ap.executor.RunningForAgent(agent.Name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list executions")
+	}
+
+	// agents only run one job at a time so if the previous agent config is still held the job is using it
+	if count > 0 && agent.PreviousAgentConfig == nil {
+		log.WithField("agentName", agent.Name).Info("keeping agent config until the running job completes")
+
+		agent.PreviousAgentConfig = agent.AgentConfig
+		return nil
+	}
+
+	err = ap.buildkiteAPI.Disconnect(agent.AgentConfig)
+	if err != nil {
+		log.WithError(err).WithField("agentName", agent.Name).Warn("failed to disconnect agent before registration")
+	}
+
+	return nil
+}
+
+// rotateToken register the agent again to replace its access token, this is done while holding the agent lock so
+// only one poller replaces the token, jobs accepted with the old token keep using it until they complete
+func (ap *AgentPool) rotateToken(agentInstance *AgentInstance, deadline time.Time) error {
+
 	agent := agentInstance.Agent()
-	agent.AgentConfig = agentConfig
 
-	agent, err = ap.agentStore.CreateOrUpdate(agent)
+	if agent.PreviousAgentConfig != nil {
+		log.WithField("agentName", agent.Name).Info("skipping rotation of access token until the running job completes")
+		return nil
+	}
+
+	log.WithField("agentName", agent.Name).WithField("registered", agent.Registered).Info("rotating access token")
+
+	err := ap.registerAgent(agentInstance, agentInstance.Tags())
 	if err != nil {
-		return errors.Wrap(err, "failed to save agent config")
+		return err
 	}
 
-	log.WithField("agentName", agent.Name).Info("updated agent config")
+	return ap.register(agentInstance, deadline)
+}
+
+// reregister register the agent again after buildkite rejected its access token, for example when the agent
+// was deleted in buildkite, it will be polled again after it is connected
+func (ap *AgentPool) reregister(agentInstance *AgentInstance, deadline time.Time) error {
+
+	agent := agentInstance.Agent()
+
+	log.WithField("agentName", agent.Name).Warn("access token rejected by buildkite, registering the agent again")
+
+	// the old access token can't be used to disconnect the agent
+	agent.AgentConfig = nil
+	agent.UpdateState(store.AgentStateRegistered)
+
+	return ap.register(agentInstance, deadline)
+}
+
+// updateAgent apply the change to the agent held by the pool and to the latest version of the stored agent, the
+// stored agent is written conditionally so changes made with the agent-cli while the pool is running aren't lost
+func (ap *AgentPool) updateAgent(agent *store.AgentRecord, update func(agent *store.AgentRecord)) error {
+
+	update(agent)
+
+	apply := func(stored *store.AgentRecord) error {
+		update(stored)
+		return nil
+	}
+
+	_, err := ap.agentStore.Update(agent.Name, apply)
+
+	// replicas are created by the pool so they are saved the first time they change
+	if err == dynalock.ErrKeyNotFound && agent.Parent != "" {
+		replica := &store.AgentRecord{Name: agent.Name, Parent: agent.Parent, Replica: agent.Replica}
+		update(replica)
+
+		err = ap.agentStore.Create(replica)
+		if err == dynalock.ErrKeyExists {
+			_, err = ap.agentStore.Update(agent.Name, apply)
+		}
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to update agent")
+	}
+
+	log.WithField("agentName", agent.Name).WithField("state", agent.State).Info("updated agent config")
 
 	return nil
 }
 
-func (ap *AgentPool) asyncPoll(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
-	resultsChan <- &AgentResult{Name: agentInstance.Name(), Error: ap.poll(agentInstance)}
+func (ap *AgentPool) asyncPoll(deadline time.Time) ActionFunc {
+	return func(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
+		result := &AgentResult{Name: agentInstance.Name()}
+		result.Error = ap.poll(agentInstance, deadline, result)
+		resultsChan <- result
+	}
 }
 
-func (ap *AgentPool) poll(agentInstance *AgentInstance) error {
+// lockAgent ensure this poller holds the lock for the agent, the lease expires shortly after the deadline
+// if it isn't released
+func (ap *AgentPool) lockAgent(agentInstance *AgentInstance, deadline time.Time) (bool, error) {
 
-	// use the token from the agent config
-	beat, err := ap.buildkiteAPI.Beat(agentInstance.AgentConfig().AccessToken)
+	if agentInstance.lock != nil {
+		if agentInstance.lock.Held() {
+			return true, nil
+		}
+
+		log.WithField("agentName", agentInstance.Name()).Warn("lost lock for agent")
+
+		_ = agentInstance.lock.Release()
+		agentInstance.lock = nil
+	}
+
+	locker, err := ap.agentStore.NewLock(agentInstance.Name(), time.Until(deadline)+lockTTLPadding)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create agent lock")
+	}
+
+	lock, err := acquireLock(locker, func() error {
+		return ap.agentStore.DeleteLock(agentInstance.Name())
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if lock == nil {
+		return false, nil
+	}
+
+	agentInstance.lock = lock
+
+	err = ap.refreshAgent(agentInstance.Agent())
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// refreshAgent reload the registration of the agent once the lock is acquired, another poller may have registered,
+// connected or disconnected the agent since it was loaded
+func (ap *AgentPool) refreshAgent(agent *store.AgentRecord) error {
+
+	stored, err := ap.agentStore.Get(agent.Name)
+	if err == dynalock.ErrKeyNotFound {
+		return nil // replicas aren't stored until they are registered
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to load agent")
+	}
+
+	agent.AgentConfig = stored.AgentConfig
+	agent.PreviousAgentConfig = stored.PreviousAgentConfig
+	agent.Registered = stored.Registered
+	agent.RegisteredTags = stored.RegisteredTags
+	agent.RegisteredPriority = stored.RegisteredPriority
+	agent.RegisteredAgentKeyParam = stored.RegisteredAgentKeyParam
+	agent.State = stored.State
+	agent.StateUpdated = stored.StateUpdated
+
+	return nil
+}
+
+func (ap *AgentPool) poll(agentInstance *AgentInstance, deadline time.Time, result *AgentResult) error {
+
+	// only connected agents can poll for jobs
+	if !agentInstance.Agent().Active() || !agentInstance.Agent().Connected() {
+		log.WithField("agentName", agentInstance.Name()).Info("skipping poll of agent which isn't connected")
+		return nil
+	}
+
+	locked, err := ap.lockAgent(agentInstance, deadline)
 	if err != nil {
+		return errors.Wrap(err, "failed to lock agent")
+	}
+
+	if !locked {
+		log.WithField("agentName", agentInstance.Name()).Info("skipping poll of agent locked by another poller")
+		return nil
+	}
+
+	// the registration was reloaded when the lock was acquired as another poller may have disconnected the agent
+	if !agentInstance.Agent().Connected() {
+		log.WithField("agentName", agentInstance.Name()).Info("skipping poll of agent which isn't connected")
+		return nil
+	}
+
+	if agentInstance.Agent().TokenExpired(ap.cfg.AgentTokenMaxAge) {
+		err := ap.rotateToken(agentInstance, deadline)
+		if err != nil {
+			return errors.Wrap(err, "failed to rotate access token")
+		}
+	}
+
+	// use the token and endpoint from the agent config
+	beat, err := ap.buildkiteAPI.Beat(agentInstance.AgentConfig())
+	if err != nil {
+		if _, ok := errors.Cause(err).(*bk.UnauthorizedError); ok {
+			return ap.reregister(agentInstance, deadline)
+		}
+
 		return errors.Wrap(err, "failed to send heartbeat to buildkite")
 	}
 
 	log.Infof("Heartbeat sent at %s and received at %s", beat.SentAt, beat.ReceivedAt)
 
-	ping, err := ap.buildkiteAPI.Ping(agentInstance.AgentConfig().AccessToken)
+	ping, err := ap.buildkiteAPI.Ping(agentInstance.AgentConfig())
 	if err != nil {
 		return errors.Wrap(err, "failed to ping buildkite")
 	}
 
 	log.WithField("Action", ping.Action).WithField("Message", ping.Message).Info("Received ping from buildkite api")
 
+	result.Action = ping.Action
+	result.PingInterval = time.Duration(agentInstance.AgentConfig().PingInterval) * time.Second
+
+	accept, err := ap.applyPingAction(agentInstance, ping)
+	if err != nil {
+		return errors.Wrap(err, "failed to apply ping action")
+	}
+
+	// a paused or disconnected agent won't be given any jobs
+	result.Polled = accept
+
+	if !accept {
+		return nil // we are done
+	}
+
 	if ping.Job == nil {
 		log.Info("Ping to endpoint returned no job")
 
@@ -207,14 +574,11 @@ func (ap *AgentPool) poll(agentInstance *AgentInstance) error {
 
 	log.WithField("state", ping.Job.State).Info("Job received")
 
-	if ping.Job.State == "canceling" {
-
-		ping.Job.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
-		ping.Job.ExitStatus = "-99"
+	if ping.Job.State == "canceling" || ping.Job.State == "canceled" {
 
-		err := ap.buildkiteAPI.FinishJob(agentInstance.AgentConfig().AccessToken, ping.Job)
+		err := ap.canceller.CancelJob(agentInstance.Name(), agentInstance.AgentConfig(), ping.Job)
 		if err != nil {
-			return errors.Wrap(err, "failed to finish canceling job")
+			return errors.Wrap(err, "failed to cancel job")
 		}
 
 		return nil // we are done
@@ -225,24 +589,44 @@ func (ap *AgentPool) poll(agentInstance *AgentInstance) error {
 		return errors.Wrap(err, "failed to list executions")
 	}
 
-	if count >= 1 {
+	if count >= bk.MaxAgentConcurrentJobs {
 		log.Infof("Running %d executions so not retrieving a job", count)
 		return nil // we are done as there is already a job running
 	}
 
-	job, err := ap.buildkiteAPI.AcceptJob(agentInstance.AgentConfig().AccessToken, ping.Job)
+	job, err := ap.buildkiteAPI.AcceptJob(agentInstance.AgentConfig(), ping.Job)
 	if err != nil {
+		// accepting a job isn't retried, buildkite will offer it again on the next ping
+		if bk.IsRetryable(err) {
+			log.WithError(err).Warn("failed to accept job, waiting for the next ping")
+			return nil
+		}
+
 		return errors.Wrap(err, "failed to accept job from endpoint")
 	}
 
 	wd := &bk.WorkflowData{
-		Job:       job,
-		AgentName: agentInstance.Name(),
+		SchemaVersion: bk.WorkflowSchemaVersion,
+		Job:           job,
+		AgentName:     agentInstance.Name(),
+		AgentTokenID:  store.TokenID(agentInstance.AgentConfig().AccessToken),
 		Codebuild: &bk.CodebuildWorkflowData{
 			ProjectName: agentInstance.CodebuildProject(),
 		},
 	}
 
+	// the execution is passed a reference to the job, this keeps large jobs within the size limit of the execution
+	// input and the access token of the job out of the execution history
+	if ap.cfg.ClaimCheckJobs {
+		err = ap.workflowStore.SaveJob(job.ID, job)
+		if err != nil {
+			return errors.Wrap(err, "failed to save job to workflow store")
+		}
+
+		wd.Job = nil
+		wd.JobRef = job.ID
+	}
+
 	data, err := json.Marshal(wd)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal job")
@@ -253,17 +637,151 @@ func (ap *AgentPool) poll(agentInstance *AgentInstance) error {
 		return errors.Wrap(err, "failed to start execution")
 	}
 
+	result.JobAccepted = true
+
 	return nil
 }
 
+// applyPingAction act on the action and endpoint returned by the buildkite ping, returns false if the agent
+// can't accept jobs
+func (ap *AgentPool) applyPingAction(agentInstance *AgentInstance, ping *api.Ping) (bool, error) {
+
+	agent := agentInstance.Agent()
+
+	endpoint := ""
+	state := ""
+	accept := true
+
+	if ping.Endpoint != "" && ping.Endpoint != agent.AgentConfig.Endpoint {
+		log.WithField("agentName", agent.Name).WithField("endpoint", ping.Endpoint).Info("agent endpoint changed")
+
+		endpoint = ping.Endpoint
+	}
+
+	switch ping.Action {
+	case pingActionDisconnect:
+		// the agent config is retained as running jobs use it to report their status
+		err := ap.buildkiteAPI.Disconnect(agent.AgentConfig)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to disconnect agent")
+		}
+
+		state = store.AgentStateDisconnected
+		accept = false
+	case pingActionPause:
+		if agent.State != store.AgentStatePaused {
+			state = store.AgentStatePaused
+		}
+		accept = false
+	default:
+		if agent.State == store.AgentStatePaused {
+			state = store.AgentStateConnected
+		}
+	}
+
+	if endpoint == "" && state == "" {
+		return accept, nil
+	}
+
+	accessToken := agent.AgentConfig.AccessToken
+
+	return accept, ap.updateAgent(agent, func(agent *store.AgentRecord) {
+		// the endpoint belongs to the access token which was pinged
+		if endpoint != "" && agent.AgentConfig != nil && agent.AgentConfig.AccessToken == accessToken {
+			agent.AgentConfig.Endpoint = endpoint
+		}
+
+		if state != "" {
+			agent.UpdateState(state)
+		}
+	})
+}
+
 func (ap *AgentPool) asyncCleanup(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
 	resultsChan <- &AgentResult{Name: agentInstance.Name(), Error: ap.cleanup(agentInstance)}
 }
 
 func (ap *AgentPool) cleanup(agentInstance *AgentInstance) error {
 
-	log.WithField("name", agentInstance.Name()).Info("cleanup renew channel")
-	// close(agentInstance.renewChan)
+	if agentInstance.lock != nil {
+		err := agentInstance.lock.Release()
+		if err != nil {
+			log.WithError(err).WithField("agentName", agentInstance.Name()).Warn("failed to release agent lock")
+		}
+
+		agentInstance.lock = nil
+	}
 
-	return nil
+	agent := agentInstance.Agent()
+
+	if agent.PreviousAgentConfig != nil {
+		err := ap.disconnectPrevious(agent)
+		if err != nil {
+			return err
+		}
+	}
+
+	if agent.Active() {
+		return nil
+	}
+
+	if agent.AgentConfig != nil {
+
+		// wait for any running jobs to complete as they rely on the agent config
+		count, err := ap.executor.RunningForAgent(agent.Name)
+		if err != nil {
+			return errors.Wrap(err, "failed to list executions")
+		}
+
+		if count > 0 {
+			log.WithField("agentName", agent.Name).Infof("Running %d executions so not disconnecting agent", count)
+			return nil
+		}
+
+		err = ap.buildkiteAPI.Disconnect(agent.AgentConfig)
+		if err != nil {
+			return errors.Wrap(err, "failed to disconnect agent")
+		}
+	} else if agent.State == store.AgentStateDisconnected && !agent.Removed {
+		return nil // nothing to do as it is already disconnected
+	}
+
+	if agent.Removed {
+		err := ap.agentStore.Delete(agent.Name)
+		if err != nil {
+			return errors.Wrap(err, "failed to delete agent")
+		}
+
+		log.WithField("agentName", agent.Name).Info("deleted removed agent")
+
+		return nil
+	}
+
+	return ap.updateAgent(agent, func(agent *store.AgentRecord) {
+		agent.AgentConfig = nil
+		agent.RegisteredTags = nil
+		agent.UpdateState(store.AgentStateDisconnected)
+	})
+}
+
+// disconnectPrevious disconnect the agent replaced when the access token was rotated once its job has completed
+func (ap *AgentPool) disconnectPrevious(agent *store.AgentRecord) error {
+
+	count, err := ap.executor.RunningForAgent(agent.Name)
+	if err != nil {
+		return errors.Wrap(err, "failed to list executions")
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	err = ap.buildkiteAPI.Disconnect(agent.PreviousAgentConfig)
+	if err != nil {
+		log.WithError(err).WithField("agentName", agent.Name).Warn("failed to disconnect previous agent")
+	}
+
+	return ap.updateAgent(agent, func(agent *store.AgentRecord) {
+		agent.PreviousAgentConfig = nil
+	})
 }
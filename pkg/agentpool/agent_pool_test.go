@@ -1,6 +1,7 @@
 package agentpool
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -10,8 +11,10 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
+	"github.com/wolfeidau/dynalock"
 )
 
 func TestNew(t *testing.T) {
@@ -52,10 +55,7 @@ func TestAgentPool_RegisterAgents(t *testing.T) {
 	paramStore := &mocks.Store{}
 
 	paramStore.On("GetAgentKey", "/dev/1/buildkite-agent-key").Return("abc123", nil)
-
-	agentStore := &mocks.AgentsAPI{}
-	agentRecord := &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"aws", "serverless", "codebuild", "", "queue=dev"}, AgentConfig: &api.Agent{}}
-	agentStore.On("CreateOrUpdate", agentRecord).Return(agentRecord, nil)
+	paramStore.On("GetAgentKey", "/dev/1/other-org-agent-key").Return("def456", nil)
 
 	cfg := &config.Config{
 		EnvironmentName:   "dev",
@@ -71,10 +71,17 @@ func TestAgentPool_RegisterAgents(t *testing.T) {
 		returnArguments []interface{}
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		apiMock apiMock
-		wantErr bool
+		name         string
+		fields       fields
+		apiMock      []apiMock
+		running      int
+		locker       *fakeLocker
+		stored       storedAgents // agents in the store when they are locked
+		wantLocked   bool
+		wantState    string
+		wantTags     []string
+		wantPrevious *api.Agent
+		wantErr      bool
 	}{
 		{
 			name: "RegisterAgents() with valid pool",
@@ -83,12 +90,49 @@ func TestAgentPool_RegisterAgents(t *testing.T) {
 					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"aws", "serverless", "codebuild", "", "queue=dev"}}},
 				},
 			},
-			apiMock: apiMock{
-				method:          "Register",
-				arguments:       []interface{}{"deployer-dev-1", "abc123", []string{"aws", "serverless", "codebuild", "", "queue=dev"}},
-				returnArguments: []interface{}{&api.Agent{}, nil},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", []string{"aws", "serverless", "codebuild", "", "queue=dev"}, ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token123"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
 			},
-			wantErr: false,
+			wantState: store.AgentStateConnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "", "queue=dev"},
+			wantErr:   false,
+		},
+		{
+			name: "RegisterAgents() with agent key param",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", AgentKeyParam: "/dev/1/other-org-agent-key", AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "def456", []string{"aws", "serverless", "codebuild", "queue=dev"}, ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			wantState: store.AgentStateConnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "queue=dev"},
+			wantErr:   false,
 		},
 		{
 			name: "RegisterAgents() with failed api call",
@@ -97,32 +141,306 @@ func TestAgentPool_RegisterAgents(t *testing.T) {
 					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"aws", "serverless", "codebuild", "", "queue=dev"}}},
 				},
 			},
-			apiMock: apiMock{
-				method:          "Register",
-				arguments:       []interface{}{"deployer-dev-1", "abc123", []string{"aws", "serverless", "codebuild", "", "queue=dev"}},
-				returnArguments: []interface{}{nil, errors.New("whoops")},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", []string{"aws", "serverless", "codebuild", "", "queue=dev"}, ""},
+					returnArguments: []interface{}{nil, errors.New("whoops")},
+				},
 			},
 			wantErr: true,
 		},
+		{
+			name: "RegisterAgents() with stored queue and changed tags",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-2", Tags: []string{"queue=deploy"}, AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-2", "abc123", []string{"aws", "serverless", "codebuild", "queue=deploy"}, ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			wantState: store.AgentStateConnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "queue=deploy"},
+			wantErr:   false,
+		},
+		{
+			name: "RegisterAgents() with changed tags and a running job",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-2", Tags: []string{"queue=deploy"}, AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-2", "abc123", []string{"aws", "serverless", "codebuild", "queue=deploy"}, ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			running:      1,
+			wantState:    store.AgentStateConnected,
+			wantTags:     []string{"aws", "serverless", "codebuild", "queue=deploy"},
+			wantPrevious: &api.Agent{AccessToken: "token123"},
+			wantErr:      false,
+		},
+		{
+			name: "RegisterAgents() with changed priority",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Priority: "10", AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", []string{"aws", "serverless", "codebuild", "queue=dev"}, "10"},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			wantState: store.AgentStateConnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "queue=dev"},
+			wantErr:   false,
+		},
+		{
+			name: "RegisterAgents() with registered agent which isn't connected",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateRegistered}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			wantState: store.AgentStateConnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "queue=dev"},
+			wantErr:   false,
+		},
+		{
+			name: "RegisterAgents() with agent disconnected by buildkite",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateDisconnected}},
+				},
+			},
+			wantState: store.AgentStateDisconnected,
+			wantTags:  []string{"aws", "serverless", "codebuild", "queue=dev"},
+			wantErr:   false,
+		},
+		{
+			name: "RegisterAgents() with agent locked by another poller",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"aws", "serverless", "codebuild", "", "queue=dev"}}},
+				},
+			},
+			locker:     &fakeLocker{heldElsewhere: true},
+			wantLocked: false,
+			wantErr:    false,
+		},
+		{
+			name: "RegisterAgents() with agent registered by another poller since it was loaded",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"queue=dev"}}},
+				},
+			},
+			stored: storedAgents{
+				"deployer-dev-1": &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"queue=dev"}, AgentConfig: &api.Agent{AccessToken: "token456"}, RegisteredTags: []string{"aws", "serverless", "codebuild", "queue=dev"}, State: store.AgentStateConnected},
+			},
+			wantLocked: true,
+			wantState:  store.AgentStateConnected,
+			wantTags:   []string{"aws", "serverless", "codebuild", "queue=dev"},
+			wantErr:    false,
+		},
+		{
+			name: "RegisterAgents() with disabled agent",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Disabled: true}},
+				},
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
 			buildkiteAPI := &mocks.API{}
+			executor := &mocks.Executor{}
+			agentStore := &mocks.AgentsAPI{}
+
+			stored := tt.stored
+			if stored == nil {
+				stored = storedAgents{}
+			}
+
+			locker := tt.locker
+			if locker == nil {
+				locker = newFakeLocker()
+			}
+
+			executor.On("RunningForAgent", mock.AnythingOfType("string")).Return(tt.running, nil)
+			agentStore.On("NewLock", mock.AnythingOfType("string"), mock.AnythingOfType("time.Duration")).Return(locker, nil)
+			agentStore.On("Get", mock.AnythingOfType("string")).Return(stored.get, stored.getErr)
+			agentStore.On("Update", mock.AnythingOfType("string"), mock.Anything).Return(stored.update, nil)
 
 			ap := &AgentPool{
 				Agents:       tt.fields.Agents,
+				executor:     executor,
 				paramStore:   paramStore,
 				agentStore:   agentStore,
 				buildkiteAPI: buildkiteAPI,
 				cfg:          cfg,
 			}
 
-			buildkiteAPI.On(tt.apiMock.method, tt.apiMock.arguments...).Return(tt.apiMock.returnArguments...)
+			for _, mock := range tt.apiMock {
+				buildkiteAPI.On(mock.method, mock.arguments...).Return(mock.returnArguments...)
+			}
 
 			err := ap.RegisterAgents(time.Now().Add(30 * time.Second))
-			if (err != nil) != tt.wantErr {
-				require.Error(t, err)
+			require.Equal(t, tt.wantErr, err != nil)
+			buildkiteAPI.AssertExpectations(t)
+
+			if tt.locker != nil {
+				require.Equal(t, tt.wantLocked, tt.fields.Agents[0].lock != nil)
+				buildkiteAPI.AssertNotCalled(t, "Register", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			}
+
+			if tt.wantState != "" {
+				require.Equal(t, tt.wantState, tt.fields.Agents[0].Agent().State)
+				require.Equal(t, tt.wantTags, tt.fields.Agents[0].Agent().RegisteredTags)
+				require.Equal(t, tt.wantPrevious, tt.fields.Agents[0].Agent().PreviousAgentConfig)
+			}
+		})
+	}
+}
+
+func TestAgentPool_CleanupAgents(t *testing.T) {
+
+	cfg := &config.Config{
+		EnvironmentName:   "dev",
+		EnvironmentNumber: "1",
+	}
+
+	tests := []struct {
+		name       string
+		agent      *store.AgentRecord
+		running    int
+		disconnect string
+		update     bool
+		delete     bool
+		wantState  string
+	}{
+		{
+			name:  "CleanupAgents() with active agent",
+			agent: &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected},
+		},
+		{
+			name:       "CleanupAgents() with disabled agent",
+			agent:      &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected, Disabled: true},
+			disconnect: "token123",
+			update:     true,
+			wantState:  store.AgentStateDisconnected,
+		},
+		{
+			name:      "CleanupAgents() with disabled agent running a job",
+			agent:     &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected, Disabled: true},
+			running:   1,
+			wantState: store.AgentStateConnected,
+		},
+		{
+			name:       "CleanupAgents() with previous agent config",
+			agent:      &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token456"}, PreviousAgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected},
+			disconnect: "token123",
+			update:     true,
+			wantState:  store.AgentStateConnected,
+		},
+		{
+			name:      "CleanupAgents() with previous agent config running a job",
+			agent:     &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token456"}, PreviousAgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected},
+			running:   1,
+			wantState: store.AgentStateConnected,
+		},
+		{
+			name:      "CleanupAgents() with disconnected agent",
+			agent:     &store.AgentRecord{Name: "deployer-dev-1", State: store.AgentStateDisconnected, Disabled: true},
+			wantState: store.AgentStateDisconnected,
+		},
+		{
+			name:       "CleanupAgents() with removed agent",
+			agent:      &store.AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}, State: store.AgentStateConnected, Removed: true},
+			disconnect: "token123",
+			delete:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buildkiteAPI := &mocks.API{}
+			agentStore := &mocks.AgentsAPI{}
+			executor := &mocks.Executor{}
+
+			executor.On("RunningForAgent", "deployer-dev-1").Return(tt.running, nil)
+
+			if tt.disconnect != "" {
+				buildkiteAPI.On("Disconnect", mocks.AccessToken(tt.disconnect)).Return(nil)
+			}
+			if tt.update {
+				agentStore.On("Update", "deployer-dev-1", mock.Anything).Return(storedAgents{}.update, nil)
+			}
+			if tt.delete {
+				agentStore.On("Delete", "deployer-dev-1").Return(nil)
+			}
+
+			ap := &AgentPool{
+				Agents:       []*AgentInstance{NewAgentInstance(cfg, tt.agent)},
+				executor:     executor,
+				agentStore:   agentStore,
+				buildkiteAPI: buildkiteAPI,
+				cfg:          cfg,
+			}
+
+			err := ap.CleanupAgents(time.Now().Add(30 * time.Second))
+			require.Nil(t, err)
+			buildkiteAPI.AssertExpectations(t)
+			agentStore.AssertExpectations(t)
+
+			if tt.wantState != "" {
+				require.Equal(t, tt.wantState, tt.agent.State)
 			}
 		})
 	}
@@ -134,7 +452,8 @@ func TestAgentPool_PollAgents(t *testing.T) {
 
 	paramStore.On("GetAgentKey", "/dev/1/buildkite-agent-key").Return("abc123", nil)
 
-	agentStore := &mocks.AgentsAPI{}
+	defer func(timeout time.Duration) { lockAcquireTimeout = timeout }(lockAcquireTimeout)
+	lockAcquireTimeout = 10 * time.Millisecond
 
 	cfg := &config.Config{
 		EnvironmentName:   "dev",
@@ -152,57 +471,480 @@ func TestAgentPool_PollAgents(t *testing.T) {
 	tests := []struct {
 		name         string
 		fields       fields
+		locker       *fakeLocker
 		apiMock      []apiMock
 		executorMock apiMock
+		wantLocked   bool
+		want         *PollResult
+		wantState    string
+		wantEndpoint string
+		wantCanceled bool
+		claimCheck   bool
+		wantJobRef   string
+		stored       storedAgents // agents in the store when they are polled
+		wantStored   func(t *testing.T, stored storedAgents)
 		wantErr      bool
 	}{
 		{
 			name: "PollAgents() with valid pool",
 			fields: fields{
 				Agents: []*AgentInstance{
-					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123"}}},
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStateConnected}},
 				},
 			},
 			apiMock: []apiMock{
 				apiMock{
 					method:          "Beat",
-					arguments:       []interface{}{"abc123"},
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
 					returnArguments: []interface{}{&api.Heartbeat{}, nil},
 				},
 				apiMock{
 					method:          "Ping",
-					arguments:       []interface{}{"abc123"},
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
 					returnArguments: []interface{}{&api.Ping{Job: &api.Job{}}, nil},
 				},
 				apiMock{
 					method:          "AcceptJob",
-					arguments:       []interface{}{"abc123", mock.AnythingOfType("*api.Job")},
+					arguments:       []interface{}{mocks.AccessToken("abc123"), mock.AnythingOfType("*api.Job")},
 					returnArguments: []interface{}{&api.Job{}, nil},
 				},
 			},
 			executorMock: apiMock{
 				method:          "Ping",
-				arguments:       []interface{}{"abc123"},
+				arguments:       []interface{}{mocks.AccessToken("abc123")},
 				returnArguments: []interface{}{&api.Ping{Job: &api.Job{}}, nil},
 			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1, JobsAccepted: 1, PingInterval: 10 * time.Second},
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with claim checked job",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Job: &api.Job{ID: "job123"}}, nil},
+				},
+				apiMock{
+					method:          "AcceptJob",
+					arguments:       []interface{}{mocks.AccessToken("abc123"), mock.AnythingOfType("*api.Job")},
+					returnArguments: []interface{}{&api.Job{ID: "job123"}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1, JobsAccepted: 1, PingInterval: 10 * time.Second},
+			claimCheck: true,
+			wantJobRef: "job123",
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with canceling job",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Job: &api.Job{ID: "job123", State: "canceling"}}, nil},
+				},
+			},
+			locker:       newFakeLocker(),
+			wantLocked:   true,
+			wantCanceled: true,
+			want:         &PollResult{Polled: 1, PingInterval: 10 * time.Second},
+			wantErr:      false,
+		},
+		{
+			name: "PollAgents() with paused agent",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Action: "pause"}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{},
+			wantState:  store.AgentStatePaused,
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with agent resumed after pause",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStatePaused}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Action: "idle"}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1, PingInterval: 10 * time.Second},
+			wantState:  store.AgentStateConnected,
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with agent disconnected by buildkite",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", PingInterval: 10}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Action: "disconnect"}, nil},
+				},
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{},
+			wantState:  store.AgentStateDisconnected,
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with changed endpoint",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", Endpoint: "https://agent.buildkite.com/v3"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Endpoint: "https://agent-edge.buildkite.com/v3"}, nil},
+				},
+			},
+			locker:       newFakeLocker(),
+			wantLocked:   true,
+			want:         &PollResult{Polled: 1},
+			wantState:    store.AgentStateConnected,
+			wantEndpoint: "https://agent-edge.buildkite.com/v3",
+			wantErr:      false,
+		},
+		{
+			name: "PollAgents() with paused agent changed since it was loaded",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", Endpoint: "https://agent.buildkite.com/v3"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Action: "pause", Endpoint: "https://agent-edge.buildkite.com/v3"}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{},
+			wantState:  store.AgentStatePaused,
+			// the agent was removed with the agent-cli after it was loaded
+			stored: storedAgents{
+				"deployer-dev-1": &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123", Endpoint: "https://agent.buildkite.com/v3"}, Removed: true, State: store.AgentStateConnected},
+			},
+			wantStored: func(t *testing.T, stored storedAgents) {
+				agent := stored["deployer-dev-1"]
+				require.Equal(t, store.AgentStatePaused, agent.State)
+				require.Equal(t, "https://agent-edge.buildkite.com/v3", agent.AgentConfig.Endpoint)
+				require.True(t, agent.Removed)
+			},
 			wantErr: false,
 		},
+		{
+			name: "PollAgents() with job accept failing on server error",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Job: &api.Job{}}, nil},
+				},
+				apiMock{
+					method:          "AcceptJob",
+					arguments:       []interface{}{mocks.AccessToken("abc123"), mock.AnythingOfType("*api.Job")},
+					returnArguments: []interface{}{nil, errors.Wrap(&bk.APIError{StatusCode: 503}, "failed to accept job")},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1},
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with job accept rejected",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{&api.Ping{Job: &api.Job{}}, nil},
+				},
+				apiMock{
+					method:          "AcceptJob",
+					arguments:       []interface{}{mocks.AccessToken("abc123"), mock.AnythingOfType("*api.Job")},
+					returnArguments: []interface{}{nil, errors.Wrap(&bk.APIError{StatusCode: 422}, "failed to accept job")},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1},
+			wantErr:    true,
+		},
+		{
+			name: "PollAgents() with revoked access token",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123"}, State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("abc123")},
+					returnArguments: []interface{}{nil, errors.Wrap(&bk.UnauthorizedError{APIError: &bk.APIError{StatusCode: 401}}, "failed to send agent heartbeat")},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", mock.AnythingOfType("[]string"), ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{},
+			wantState:  store.AgentStateConnected,
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with access token rotation requested",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "token123"}, Registered: time.Now().Add(-time.Hour), RotateTokensBefore: time.Now(), State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", mock.AnythingOfType("[]string"), ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{&api.Ping{}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1},
+			wantState:  store.AgentStateConnected,
+			wantErr:    false,
+		},
+		{
+			name: "PollAgents() with agent changed since it was loaded",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "token123"}, Registered: time.Now().Add(-time.Hour), RotateTokensBefore: time.Now(), State: store.AgentStateConnected}},
+				},
+			},
+			apiMock: []apiMock{
+				apiMock{
+					method:          "Disconnect",
+					arguments:       []interface{}{mocks.AccessToken("token123")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Register",
+					arguments:       []interface{}{"deployer-dev-1", "abc123", mock.AnythingOfType("[]string"), ""},
+					returnArguments: []interface{}{&api.Agent{AccessToken: "token456"}, nil},
+				},
+				apiMock{
+					method:          "Connect",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{nil},
+				},
+				apiMock{
+					method:          "Beat",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{&api.Heartbeat{}, nil},
+				},
+				apiMock{
+					method:          "Ping",
+					arguments:       []interface{}{mocks.AccessToken("token456")},
+					returnArguments: []interface{}{&api.Ping{}, nil},
+				},
+			},
+			locker:     newFakeLocker(),
+			wantLocked: true,
+			want:       &PollResult{Polled: 1},
+			wantState:  store.AgentStateConnected,
+			// the agent was disabled and given a new priority with the agent-cli after it was loaded
+			stored: storedAgents{
+				"deployer-dev-1": &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "token123"}, Disabled: true, Priority: "5", State: store.AgentStateConnected},
+			},
+			wantStored: func(t *testing.T, stored storedAgents) {
+				agent := stored["deployer-dev-1"]
+				require.Equal(t, "token456", agent.AgentConfig.AccessToken)
+				require.False(t, agent.Registered.IsZero())
+				require.True(t, agent.Disabled)
+				require.Equal(t, "5", agent.Priority)
+				require.Equal(t, "", agent.RegisteredPriority)
+			},
+			wantErr: false,
+		},
+		{
+			name: "PollAgents() with agent locked by another poller",
+			fields: fields{
+				Agents: []*AgentInstance{
+					&AgentInstance{cfg: cfg, agent: &store.AgentRecord{Name: "deployer-dev-1", Tags: []string{"dev"}, AgentConfig: &api.Agent{AccessToken: "abc123"}, State: store.AgentStateConnected}},
+				},
+			},
+			locker:     &fakeLocker{heldElsewhere: true},
+			wantLocked: false,
+			want:       &PollResult{},
+			wantErr:    false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
 			buildkiteAPI := &mocks.API{}
 			executor := &mocks.Executor{}
+			agentStore := &mocks.AgentsAPI{}
+			canceller := &mocks.Canceller{}
+			workflowStore := &mocks.WorkflowStore{}
+
+			stored := tt.stored
+			if stored == nil {
+				stored = storedAgents{}
+			}
 
 			executor.On("StartExecution", "deployer-dev-1", mock.Anything, mock.Anything).Return(nil)
+			workflowStore.On("SaveJob", "job123", mock.AnythingOfType("*api.Job")).Return(nil)
+			canceller.On("CancelJob", "deployer-dev-1", mocks.AccessToken("abc123"), mock.AnythingOfType("*api.Job")).Return(nil)
+			agentStore.On("NewLock", "deployer-dev-1", mock.AnythingOfType("time.Duration")).Return(tt.locker, nil)
+			agentStore.On("Get", "deployer-dev-1").Return(stored.get, stored.getErr)
+			agentStore.On("Update", "deployer-dev-1", mock.Anything).Return(stored.update, nil)
 
 			ap := &AgentPool{
-				Agents:       tt.fields.Agents,
-				executor:     executor,
-				paramStore:   paramStore,
-				agentStore:   agentStore,
-				buildkiteAPI: buildkiteAPI,
-				cfg:          cfg,
+				Agents:        tt.fields.Agents,
+				executor:      executor,
+				canceller:     canceller,
+				paramStore:    paramStore,
+				agentStore:    agentStore,
+				workflowStore: workflowStore,
+				buildkiteAPI:  buildkiteAPI,
+				cfg:           cfg,
+			}
+
+			if tt.claimCheck {
+				claimCheckCfg := *cfg
+				claimCheckCfg.ClaimCheckJobs = true
+				ap.cfg = &claimCheckCfg
 			}
 
 			for _, mock := range tt.apiMock {
@@ -211,10 +953,124 @@ func TestAgentPool_PollAgents(t *testing.T) {
 
 			executor.On("RunningForAgent", "deployer-dev-1").Return(0, nil)
 
-			err := ap.PollAgents(time.Now().Add(30 * time.Second))
-			if (err != nil) != tt.wantErr {
-				require.Error(t, err)
+			got, err := ap.PollAgents(time.Now().Add(30 * time.Second))
+			require.Equal(t, tt.wantErr, err != nil)
+			require.Equal(t, tt.want, got)
+			buildkiteAPI.AssertExpectations(t)
+			require.Equal(t, tt.wantLocked, tt.fields.Agents[0].lock != nil)
+
+			if tt.wantState != "" {
+				require.Equal(t, tt.wantState, tt.fields.Agents[0].Agent().State)
+			}
+
+			if tt.wantCanceled {
+				canceller.AssertExpectations(t)
+			} else {
+				canceller.AssertNotCalled(t, "CancelJob", mock.Anything, mock.Anything, mock.Anything)
+			}
+
+			if tt.wantEndpoint != "" {
+				require.Equal(t, tt.wantEndpoint, tt.fields.Agents[0].AgentConfig().Endpoint)
+			}
+
+			if tt.wantStored != nil {
+				tt.wantStored(t, stored)
+			}
+
+			// the execution is passed a reference to the saved job instead of the job
+			if tt.wantJobRef != "" {
+				workflowStore.AssertExpectations(t)
+				executor.AssertCalled(t, "StartExecution", "deployer-dev-1", mock.Anything, mock.MatchedBy(func(data []byte) bool {
+					wd := new(bk.WorkflowData)
+					return json.Unmarshal(data, wd) == nil && wd.JobRef == tt.wantJobRef && wd.Job == nil
+				}))
+			} else {
+				workflowStore.AssertNotCalled(t, "SaveJob", mock.Anything, mock.Anything)
 			}
 		})
 	}
 }
+
+func Test_processResults(t *testing.T) {
+
+	cfg := &config.Config{
+		EnvironmentName:   "dev",
+		EnvironmentNumber: "1",
+	}
+
+	agents := []*AgentInstance{
+		NewAgentInstance(cfg, &store.AgentRecord{Name: "deployer-dev-1"}),
+		NewAgentInstance(cfg, &store.AgentRecord{Name: "deployer-dev-2"}),
+		NewAgentInstance(cfg, &store.AgentRecord{Name: "deployer-dev-3"}),
+	}
+
+	release := make(chan struct{})
+
+	resultsChan := dispatchAgentTasks(agents, func(agentInstance *AgentInstance, resultsChan chan *AgentResult) {
+		switch agentInstance.Name() {
+		case "deployer-dev-1":
+			resultsChan <- &AgentResult{Name: agentInstance.Name(), JobAccepted: true}
+		case "deployer-dev-2":
+			resultsChan <- &AgentResult{Name: agentInstance.Name(), Error: errors.New("whoops")}
+		case "deployer-dev-3":
+			<-release
+			resultsChan <- &AgentResult{Name: agentInstance.Name()}
+		}
+	})
+
+	results, err := processResults(agents, time.Now().Add(50*time.Millisecond), resultsChan)
+	require.Len(t, results, 2)
+	require.IsType(t, &PoolError{}, err)
+
+	poolErr := err.(*PoolError)
+	require.Len(t, poolErr.Errors, 2)
+	require.EqualError(t, poolErr.Errors["deployer-dev-2"], "whoops")
+	require.EqualError(t, poolErr.Errors["deployer-dev-3"], "timed out during API operation")
+	require.Equal(t, "2 agent(s) failed: deployer-dev-2: whoops; deployer-dev-3: timed out during API operation", err.Error())
+
+	// the late result is buffered rather than blocking the agent
+	close(release)
+	require.Equal(t, "deployer-dev-3", (<-resultsChan).Name)
+}
+
+// storedAgents stands in for the agent table, updates are applied to the stored agents so tests can check which
+// fields the pool writes, agents which haven't been stored are created
+type storedAgents map[string]*store.AgentRecord
+
+func (sa storedAgents) update(name string, update func(*store.AgentRecord) error) *store.AgentRecord {
+	agent, ok := sa[name]
+	if !ok {
+		agent = &store.AgentRecord{Name: name}
+		sa[name] = agent
+	}
+
+	if update(agent) != nil {
+		return nil
+	}
+
+	return agent
+}
+
+func (sa storedAgents) get(name string) *store.AgentRecord {
+	agent, ok := sa[name]
+	if !ok {
+		return nil
+	}
+
+	// the pool is given a copy as it would be when loaded from the store
+	loaded := *agent
+	if agent.AgentConfig != nil {
+		agentConfig := *agent.AgentConfig
+		loaded.AgentConfig = &agentConfig
+	}
+
+	return &loaded
+}
+
+func (sa storedAgents) getErr(name string) error {
+	if _, ok := sa[name]; !ok {
+		return dynalock.ErrKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package agentpool
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff exponential backoff with jitter, the wait doubles on each attempt up to the maximum with a random
+// amount of up to half the wait removed to spread out the calls from concurrent pollers
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+	jitter  func(n int64) int64 // used to inject a static jitter for testing
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:    min,
+		max:    max,
+		jitter: rand.Int63n,
+	}
+}
+
+// Next return the wait before the next attempt
+func (b *backoff) Next() time.Duration {
+
+	wait := b.max
+
+	// avoid overflowing the shift once the maximum has been reached
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		wait = b.min << b.attempt
+	}
+
+	b.attempt++
+
+	half := int64(wait / 2)
+	if half == 0 {
+		return wait
+	}
+
+	return wait - time.Duration(b.jitter(half))
+}
+
+// Reset start again from the minimum wait
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,40 @@
+package agentpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_backoff_Next(t *testing.T) {
+
+	b := newBackoff(1*time.Second, 10*time.Second)
+	b.jitter = func(n int64) int64 { return 0 }
+
+	require.Equal(t, 1*time.Second, b.Next())
+	require.Equal(t, 2*time.Second, b.Next())
+	require.Equal(t, 4*time.Second, b.Next())
+	require.Equal(t, 8*time.Second, b.Next())
+	require.Equal(t, 10*time.Second, b.Next())
+
+	b.attempt = 100
+
+	require.Equal(t, 10*time.Second, b.Next())
+
+	b.Reset()
+
+	require.Equal(t, 1*time.Second, b.Next())
+}
+
+func Test_backoff_Jitter(t *testing.T) {
+
+	b := newBackoff(4*time.Second, 10*time.Second)
+
+	for i := 0; i < 100; i++ {
+		b.Reset()
+
+		wait := b.Next()
+		require.True(t, wait > 2*time.Second && wait <= 4*time.Second, "wait %s out of range", wait)
+	}
+}
@@ -0,0 +1,31 @@
+package agentpool
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PoolError aggregates the errors returned by agents in the pool during an operation
+type PoolError struct {
+	Errors map[string]error // errors keyed by the name of the agent
+}
+
+func (pe *PoolError) Error() string {
+
+	names := make([]string, 0, len(pe.Errors))
+
+	for name := range pe.Errors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+
+	for n, name := range names {
+		msgs[n] = fmt.Sprintf("%s: %v", name, pe.Errors[name])
+	}
+
+	return fmt.Sprintf("%d agent(s) failed: %s", len(names), strings.Join(msgs, "; "))
+}
@@ -8,6 +8,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// minPollInterval wait before polling again once a job has been accepted
+	minPollInterval = 1 * time.Second
+
+	// maxPollInterval longest wait between polls while the agents are idle or polling fails
+	maxPollInterval = 20 * time.Second
+)
+
 // BuildkiteWorker handler for lambda events
 type BuildkiteWorker struct {
 	agentPool *AgentPool
@@ -43,6 +51,8 @@ func (bkw *BuildkiteWorker) Handler(ctx context.Context, evt *events.CloudWatchE
 
 	log.WithField("deadline", deadline).Info("Polling agents")
 
+	pollBackoff := newBackoff(minPollInterval, maxPollInterval)
+
 LOOP:
 
 	// loop until we are out of time, which is in our case is 60 seconds
@@ -57,15 +67,27 @@ LOOP:
 
 		default:
 
-			err = bkw.agentPool.PollAgents(deadline)
+			pollResult, err := bkw.agentPool.PollAgents(deadline)
 			if err != nil {
 				log.WithError(err).Error("failed to poll agents")
 			}
 
-			// is the current time before the deadline, if not skip the sleep
-			if time.Now().Before(deadline) {
-				time.Sleep(2 * time.Second)
+			if err == nil && pollResult.Polled == 0 {
+				log.Info("No agents available to poll")
+				break LOOP
+			}
+
+			wait := pollWait(pollBackoff, pollResult, err)
+
+			// is the next poll before the deadline, if not we are done
+			if time.Now().Add(wait).After(deadline) {
+				log.Info("Poll agents finished")
+				break LOOP
 			}
+
+			log.WithField("wait", wait).Info("Waiting to poll agents")
+
+			time.Sleep(wait)
 		}
 
 	}
@@ -79,3 +101,26 @@ LOOP:
 
 	return nil
 }
+
+// pollWait return how long to wait before polling again, once a job has been accepted the agents are polled again
+// quickly, even if polling other agents failed, otherwise the wait backs off while the agents are idle or polling fails
+func pollWait(pollBackoff *backoff, pollResult *PollResult, err error) time.Duration {
+
+	if pollResult != nil && pollResult.JobsAccepted > 0 {
+		pollBackoff.Reset()
+		return minPollInterval
+	}
+
+	if err != nil {
+		return pollBackoff.Next()
+	}
+
+	wait := pollBackoff.Next()
+
+	// never poll idle agents more often than the ping interval assigned by buildkite
+	if wait < pollResult.PingInterval {
+		return pollResult.PingInterval
+	}
+
+	return wait
+}
@@ -0,0 +1,23 @@
+package agentpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pollWait(t *testing.T) {
+
+	pollBackoff := newBackoff(minPollInterval, maxPollInterval)
+	pollBackoff.jitter = func(n int64) int64 { return 0 }
+
+	require.Equal(t, 1*time.Second, pollWait(pollBackoff, &PollResult{Polled: 1}, nil))
+	require.Equal(t, 2*time.Second, pollWait(pollBackoff, nil, errors.New("whoops")))
+	require.Equal(t, 10*time.Second, pollWait(pollBackoff, &PollResult{Polled: 1, PingInterval: 10 * time.Second}, nil))
+	require.Equal(t, 8*time.Second, pollWait(pollBackoff, &PollResult{Polled: 1, PingInterval: 5 * time.Second}, nil))
+	require.Equal(t, minPollInterval, pollWait(pollBackoff, &PollResult{Polled: 1, JobsAccepted: 1}, nil))
+	require.Equal(t, 1*time.Second, pollWait(pollBackoff, &PollResult{Polled: 1}, nil))
+	require.Equal(t, minPollInterval, pollWait(pollBackoff, &PollResult{Polled: 2, JobsAccepted: 1}, errors.New("whoops")))
+}
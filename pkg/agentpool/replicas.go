@@ -0,0 +1,77 @@
+package agentpool
+
+import (
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
+)
+
+// expandReplicas add a replica for each additional job an agent is configured to run concurrently, every replica
+// is registered as a separate buildkite agent which shares the tags and codebuild project of its parent. Replicas
+// which are no longer required are marked as removed so they are disconnected and deleted during cleanup.
+func expandReplicas(agents []*store.AgentRecord) []*store.AgentRecord {
+
+	replicas := map[string]*store.AgentRecord{}
+
+	for _, agent := range agents {
+		if agent.Parent != "" {
+			replicas[agent.Name] = agent
+		}
+	}
+
+	expanded := []*store.AgentRecord{}
+
+	for _, agent := range agents {
+		if agent.Parent != "" {
+			continue
+		}
+
+		expanded = append(expanded, agent)
+
+		for n := 2; n <= maxConcurrentJobs(agent); n++ {
+			name := store.ReplicaName(agent.Name, n)
+
+			replica, ok := replicas[name]
+			if !ok {
+				replica = &store.AgentRecord{Name: name, Parent: agent.Name, Replica: n}
+			}
+
+			delete(replicas, name)
+
+			replica.Tags = agent.Tags
+			replica.CodebuildProject = agent.CodebuildProject
+			replica.Priority = agent.Priority
+			replica.AgentKeyParam = agent.AgentKeyParam
+			replica.Disabled = agent.Disabled
+			replica.Removed = agent.Removed
+			replica.RotateTokensBefore = agent.RotateTokensBefore
+			replica.Enabled = agent.Enabled
+
+			// replicas are disconnected along with their parent, or by buildkite, so they are registered again when
+			// the parent is enabled
+			if !replica.Disabled && replica.State == store.AgentStateDisconnected && replica.StateUpdated.Before(agent.Enabled) {
+				replica.Reconnect()
+			}
+
+			expanded = append(expanded, replica)
+		}
+	}
+
+	// anything left over has either lost its parent or is beyond the configured number of jobs
+	for _, agent := range agents {
+		if _, ok := replicas[agent.Name]; ok {
+			agent.Removed = true
+			expanded = append(expanded, agent)
+		}
+	}
+
+	return expanded
+}
+
+// maxConcurrentJobs return the number of jobs the agent can run concurrently
+func maxConcurrentJobs(agent *store.AgentRecord) int {
+	if agent.MaxConcurrentJobs < 1 {
+		return bk.MaxAgentConcurrentJobs
+	}
+
+	return agent.MaxConcurrentJobs
+}
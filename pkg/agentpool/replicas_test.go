@@ -0,0 +1,93 @@
+package agentpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
+)
+
+func Test_expandReplicas(t *testing.T) {
+
+	disconnected := time.Date(2019, 4, 20, 10, 0, 0, 0, time.UTC)
+	enabled := disconnected.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		agents []*store.AgentRecord
+		want   []*store.AgentRecord
+	}{
+		{
+			name:   "expandReplicas() with single job agent",
+			agents: []*store.AgentRecord{{Name: "deployer-dev-1", Tags: []string{"queue=dev"}}},
+			want:   []*store.AgentRecord{{Name: "deployer-dev-1", Tags: []string{"queue=dev"}}},
+		},
+		{
+			name: "expandReplicas() with concurrent jobs",
+			agents: []*store.AgentRecord{
+				{Name: "deployer-dev-1", Tags: []string{"queue=dev"}, CodebuildProject: "build", Priority: "5", AgentKeyParam: "/dev/1/build-agent-key", MaxConcurrentJobs: 3},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, State: store.AgentStateConnected},
+			},
+			want: []*store.AgentRecord{
+				{Name: "deployer-dev-1", Tags: []string{"queue=dev"}, CodebuildProject: "build", Priority: "5", AgentKeyParam: "/dev/1/build-agent-key", MaxConcurrentJobs: 3},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, Tags: []string{"queue=dev"}, CodebuildProject: "build", Priority: "5", AgentKeyParam: "/dev/1/build-agent-key", State: store.AgentStateConnected},
+				{Name: "deployer-dev-1-3", Parent: "deployer-dev-1", Replica: 3, Tags: []string{"queue=dev"}, CodebuildProject: "build", Priority: "5", AgentKeyParam: "/dev/1/build-agent-key"},
+			},
+		},
+		{
+			name: "expandReplicas() with disabled agent",
+			agents: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2, Disabled: true},
+			},
+			want: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2, Disabled: true},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, Disabled: true},
+			},
+		},
+		{
+			name: "expandReplicas() with agent enabled after replicas were disconnected",
+			agents: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 3, Enabled: enabled},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, RegisteredTags: []string{"queue=dev"}, State: store.AgentStateDisconnected, StateUpdated: disconnected},
+				{Name: "deployer-dev-1-3", Parent: "deployer-dev-1", Replica: 3, State: store.AgentStateDisconnected, StateUpdated: enabled.Add(time.Minute)},
+			},
+			want: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 3, Enabled: enabled},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, Enabled: enabled, StateUpdated: disconnected},
+				{Name: "deployer-dev-1-3", Parent: "deployer-dev-1", Replica: 3, Enabled: enabled, State: store.AgentStateDisconnected, StateUpdated: enabled.Add(time.Minute)},
+			},
+		},
+		{
+			name: "expandReplicas() with disabled agent and disconnected replicas",
+			agents: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2, Disabled: true, Enabled: enabled},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, State: store.AgentStateDisconnected, StateUpdated: disconnected},
+			},
+			want: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2, Disabled: true, Enabled: enabled},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2, Disabled: true, Enabled: enabled, State: store.AgentStateDisconnected, StateUpdated: disconnected},
+			},
+		},
+		{
+			name: "expandReplicas() with orphaned replicas",
+			agents: []*store.AgentRecord{
+				{Name: "deployer-dev-1-3", Parent: "deployer-dev-1", Replica: 3},
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2},
+				{Name: "deployer-dev-2-2", Parent: "deployer-dev-2", Replica: 2},
+			},
+			want: []*store.AgentRecord{
+				{Name: "deployer-dev-1", MaxConcurrentJobs: 2},
+				{Name: "deployer-dev-1-2", Parent: "deployer-dev-1", Replica: 2},
+				{Name: "deployer-dev-1-3", Parent: "deployer-dev-1", Replica: 3, Removed: true},
+				{Name: "deployer-dev-2-2", Parent: "deployer-dev-2", Replica: 2, Removed: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, expandReplicas(tt.agents))
+		})
+	}
+}
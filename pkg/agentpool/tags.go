@@ -0,0 +1,81 @@
+package agentpool
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+)
+
+// defaultTags return the tags applied to every agent in the pool, these are taken from the AGENT_TAGS
+// configuration, falling back to the original set of serverless tags if that isn't provided.
+func defaultTags(cfg *config.Config) []string {
+
+	tags := []string{}
+
+	for _, tag := range cfg.AgentTags {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) > 0 {
+		return tags
+	}
+
+	tags = []string{"aws", "serverless", "codebuild"}
+
+	if cfg.AwsRegion != "" {
+		tags = append(tags, cfg.AwsRegion)
+	}
+
+	return append(tags, fmt.Sprintf("queue=%s", cfg.EnvironmentName))
+}
+
+// mergeTags merge the stored agent tags with the default tags, where a stored tag has the same key as a
+// default tag, for example queue=deploy, the stored tag wins.
+func mergeTags(defaults, stored []string) []string {
+
+	storedKeys := map[string]bool{}
+
+	for _, tag := range stored {
+		storedKeys[tagKey(tag)] = true
+	}
+
+	tags := []string{}
+
+	for _, tag := range defaults {
+		if !storedKeys[tagKey(tag)] {
+			tags = append(tags, tag)
+		}
+	}
+
+	return append(tags, stored...)
+}
+
+// tagsEqual compare two lists of tags ignoring the order
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sa := append([]string{}, a...)
+	sb := append([]string{}, b...)
+
+	sort.Strings(sa)
+	sort.Strings(sb)
+
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tagKey returns the key for tags in the form key=value, otherwise the tag itself
+func tagKey(tag string) string {
+	return strings.SplitN(tag, "=", 2)[0]
+}
@@ -0,0 +1,76 @@
+package agentpool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+)
+
+func Test_defaultTags(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		want []string
+	}{
+		{
+			name: "defaultTags() with no agent tags configured",
+			cfg:  &config.Config{EnvironmentName: "dev", AwsRegion: "ap-southeast-2"},
+			want: []string{"aws", "serverless", "codebuild", "ap-southeast-2", "queue=dev"},
+		},
+		{
+			name: "defaultTags() with empty agent tags configured",
+			cfg:  &config.Config{EnvironmentName: "dev", AgentTags: []string{""}},
+			want: []string{"aws", "serverless", "codebuild", "queue=dev"},
+		},
+		{
+			name: "defaultTags() with agent tags configured",
+			cfg:  &config.Config{EnvironmentName: "dev", AgentTags: []string{"serverless", "queue=default"}},
+			want: []string{"serverless", "queue=default"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, defaultTags(tt.cfg))
+		})
+	}
+}
+
+func Test_mergeTags(t *testing.T) {
+	type args struct {
+		defaults []string
+		stored   []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{
+			name: "mergeTags() with no stored tags",
+			args: args{defaults: []string{"aws", "queue=dev"}},
+			want: []string{"aws", "queue=dev"},
+		},
+		{
+			name: "mergeTags() with stored queue",
+			args: args{defaults: []string{"aws", "queue=dev"}, stored: []string{"queue=deploy", "docker=true"}},
+			want: []string{"aws", "queue=deploy", "docker=true"},
+		},
+		{
+			name: "mergeTags() with duplicate tags",
+			args: args{defaults: []string{"aws", "queue=dev"}, stored: []string{"aws"}},
+			want: []string{"queue=dev", "aws"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, mergeTags(tt.args.defaults, tt.args.stored))
+		})
+	}
+}
+
+func Test_tagsEqual(t *testing.T) {
+	require.True(t, tagsEqual([]string{"aws", "queue=dev"}, []string{"queue=dev", "aws"}))
+	require.False(t, tagsEqual([]string{"aws", "queue=dev"}, []string{"aws", "queue=deploy"}))
+	require.False(t, tagsEqual(nil, []string{"aws"}))
+}
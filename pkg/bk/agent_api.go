@@ -2,39 +2,70 @@ package bk
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/api"
 	"github.com/pkg/errors"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/telemetry"
 )
 
 // AgentAPI wrapper around all the buildkite api operations
 type AgentAPI struct {
+	endpoint  string
+	timeout   time.Duration
+	transport http.RoundTripper
+
+	clientsMu sync.Mutex
+	clients   map[string]*cachedClient
+}
+
+// cachedClient the client for an agent, this is replaced when the access token or endpoint of the agent changes
+type cachedClient struct {
+	endpoint string
+	token    string
+	client   *api.Client
 }
 
-// NewAgentAPI create a new agent api
-func NewAgentAPI() *AgentAPI {
-	return &AgentAPI{}
+// NewAgentAPI create a new agent api, all agents share the same http transport
+func NewAgentAPI(cfg *config.Config) *AgentAPI {
+
+	endpoint := cfg.AgentEndpoint
+	if endpoint == "" {
+		endpoint = DefaultAPIEndpoint
+	}
+
+	return &AgentAPI{
+		endpoint:  endpoint,
+		timeout:   cfg.HTTPTimeout,
+		transport: &errorBodyTransport{next: newTransport(cfg)},
+		clients:   make(map[string]*cachedClient),
+	}
 }
 
-// Register register an agent
-func (ab *AgentAPI) Register(agentName string, agentKey string, tags []string) (*api.Agent, error) {
+// Register register an agent, agents with a higher priority are assigned jobs first
+func (ab *AgentAPI) Register(agentName string, agentKey string, tags []string, priority string) (*api.Agent, error) {
 	defer telemetry.MeasureSince("register", time.Now())
 
-	client := newAgent(agentKey)
+	// agents are registered infrequently so the client isn't cached
+	client := ab.newClient(ab.endpoint, agentKey)
 
 	agentConfig, res, err := client.Agents.Register(&api.Agent{
-		Name: agentName,
-		// Priority:          r.Priority,
-		Tags:    tags,
-		Version: Version,
-		Build:   BuildVersion,
-		Arch:    runtime.GOARCH,
-		OS:      runtime.GOOS,
+		Name:     agentName,
+		Priority: priority,
+		Tags:     tags,
+		Version:  Version,
+		Build:    BuildVersion,
+		Arch:     runtime.GOARCH,
+		OS:       runtime.GOOS,
 	})
+	err = checkResponse(res, err)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to register agent")
 	}
@@ -43,13 +74,46 @@ func (ab *AgentAPI) Register(agentName string, agentKey string, tags []string) (
 	return agentConfig, nil
 }
 
+// Connect connect the agent to the agent api
+func (ab *AgentAPI) Connect(agentConfig *api.Agent) error {
+	defer telemetry.MeasureSince("connect", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	res, err := client.Agents.Connect()
+	err = checkResponse(res, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect agent")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return nil
+}
+
+// Disconnect disconnect the agent from the agent api
+func (ab *AgentAPI) Disconnect(agentConfig *api.Agent) error {
+	defer telemetry.MeasureSince("disconnect", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	res, err := client.Agents.Disconnect()
+	err = checkResponse(res, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to disconnect agent")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return nil
+}
+
 // Beat send a heartbeat to the agent api
-func (ab *AgentAPI) Beat(agentKey string) (*api.Heartbeat, error) {
+func (ab *AgentAPI) Beat(agentConfig *api.Agent) (*api.Heartbeat, error) {
 	defer telemetry.MeasureSince("beat", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	heartbeat, res, err := client.Heartbeats.Beat()
+	err = checkResponse(res, err)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to send agent heartbeat")
 	}
@@ -59,12 +123,13 @@ func (ab *AgentAPI) Beat(agentKey string) (*api.Heartbeat, error) {
 }
 
 // Ping ping the agent api for a job
-func (ab *AgentAPI) Ping(agentKey string) (*api.Ping, error) {
+func (ab *AgentAPI) Ping(agentConfig *api.Agent) (*api.Ping, error) {
 	defer telemetry.MeasureSince("ping", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	ping, res, err := client.Pings.Get()
+	err = checkResponse(res, err)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to send agent ping")
 	}
@@ -74,12 +139,13 @@ func (ab *AgentAPI) Ping(agentKey string) (*api.Ping, error) {
 }
 
 // AcceptJob accept the job provided by buildkite
-func (ab *AgentAPI) AcceptJob(agentKey string, job *api.Job) (*api.Job, error) {
+func (ab *AgentAPI) AcceptJob(agentConfig *api.Agent, job *api.Job) (*api.Job, error) {
 	defer telemetry.MeasureSince("acceptjob", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	job, res, err := client.Jobs.Accept(job)
+	err = checkResponse(res, err)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to accept job")
 	}
@@ -89,55 +155,48 @@ func (ab *AgentAPI) AcceptJob(agentKey string, job *api.Job) (*api.Job, error) {
 }
 
 // StartJob start the job provided by buildkite
-func (ab *AgentAPI) StartJob(agentKey string, job *api.Job) error {
+func (ab *AgentAPI) StartJob(agentConfig *api.Agent, job *api.Job) error {
 	defer telemetry.MeasureSince("startjob", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	// update the started date
 	job.StartedAt = time.Now().UTC().Format(time.RFC3339Nano)
 
 	res, err := client.Jobs.Start(job)
+	err = checkResponse(res, err)
 	if err != nil {
 		return errors.Wrap(err, "failed to start job")
 	}
 	defer telemetry.ReportAPIResponse(res)
 
-	// we failed to start the job
-	if res.StatusCode > 299 {
-		return errors.Errorf("failed to start job, returned status: %s", res.Status)
-	}
-
 	return nil
 }
 
 // GetStateJob get the state of the job
-func (ab *AgentAPI) GetStateJob(agentKey string, jobID string) (*api.JobState, error) {
+func (ab *AgentAPI) GetStateJob(agentConfig *api.Agent, jobID string) (*api.JobState, error) {
 	defer telemetry.MeasureSince("getstatejob", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	jobState, res, err := client.Jobs.GetState(jobID)
+	err = checkResponse(res, err)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get job state")
 	}
 	defer telemetry.ReportAPIResponse(res)
 
-	// we failed to start the job
-	if res.StatusCode > 299 {
-		return nil, errors.Errorf("failed to get job state, returned status: %s", res.Status)
-	}
-
 	return jobState, nil
 }
 
 // ChunksUpload upload chunk of log data
-func (ab *AgentAPI) ChunksUpload(agentKey string, jobID string, chunk *api.Chunk) error {
+func (ab *AgentAPI) ChunksUpload(agentConfig *api.Agent, jobID string, chunk *api.Chunk) error {
 	defer telemetry.MeasureSince("chunkUpload", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	res, err := client.Chunks.Upload(jobID, chunk)
+	err = checkResponse(res, err)
 	if err != nil {
 		return errors.Wrap(err, "failed to upload chunk")
 	}
@@ -146,33 +205,211 @@ func (ab *AgentAPI) ChunksUpload(agentKey string, jobID string, chunk *api.Chunk
 	return nil
 }
 
-// FinishJob finish the job provided by buildkite
-func (ab *AgentAPI) FinishJob(agentKey string, job *api.Job) error {
-	defer telemetry.MeasureSince("getstatejob", time.Now())
+// SignalReasonProcessRunError the signal reason reported when the job failed without running the command, buildkite
+// only accepts the signal reasons it documents so details of the failure belong in the job log
+const SignalReasonProcessRunError = "process_run_error"
+
+// jobFinishRequest the api client doesn't send the signal reason when finishing a job
+type jobFinishRequest struct {
+	ExitStatus        string `json:"exit_status,omitempty"`
+	SignalReason      string `json:"signal_reason,omitempty"`
+	FinishedAt        string `json:"finished_at,omitempty"`
+	ChunksFailedCount int    `json:"chunks_failed_count"`
+}
+
+// FinishJob finish the job provided by buildkite, the signal reason is optional and explains why the job failed
+// without running the command, for example SignalReasonProcessRunError
+func (ab *AgentAPI) FinishJob(agentConfig *api.Agent, job *api.Job, signalReason string) error {
+	defer telemetry.MeasureSince("finishjob", time.Now())
 
-	client := newAgent(agentKey)
+	client := ab.agentClient(agentConfig)
 
 	job.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
 	job.ChunksFailedCount = 0
 
-	res, err := client.Jobs.Finish(job)
+	req, err := client.NewRequest("PUT", fmt.Sprintf("jobs/%s/finish", job.ID), &jobFinishRequest{
+		ExitStatus:        job.ExitStatus,
+		SignalReason:      signalReason,
+		FinishedAt:        job.FinishedAt,
+		ChunksFailedCount: job.ChunksFailedCount,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to build finish job request")
+	}
+
+	res, err := client.Do(req, nil)
+	err = checkResponse(res, err)
 	if err != nil {
+		// buildkite rejects the call to finish a job which has already finished
+		if apiErr, ok := err.(*APIError); ok && jobAlreadyFinished(apiErr) {
+			err = &JobAlreadyFinishedError{apiErr}
+		}
 		return errors.Wrap(err, "failed to finish job")
 	}
 
 	defer telemetry.ReportAPIResponse(res)
 
-	if res.StatusCode == 422 {
-		return errors.Errorf("Buildkite rejected the call to finish the job (%s)", res.Status)
+	return nil
+}
+
+// jobAlreadyFinished was the call to finish the job rejected because it has already finished, buildkite also returns
+// 422 when the request is invalid, for example an unknown signal reason, so the message is checked
+func jobAlreadyFinished(apiErr *APIError) bool {
+	if apiErr.StatusCode != http.StatusUnprocessableEntity {
+		return false
 	}
 
+	msg := strings.ToLower(apiErr.Message + " " + string(apiErr.Body))
+
+	return strings.Contains(msg, "already") && strings.Contains(msg, "finished")
+}
+
+// SetMetaData set a meta-data value on the build of the job
+func (ab *AgentAPI) SetMetaData(agentConfig *api.Agent, jobID string, key string, value string) error {
+	defer telemetry.MeasureSince("setmetadata", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	res, err := client.MetaData.Set(jobID, &api.MetaData{Key: key, Value: value})
+	err = checkResponse(res, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to set meta-data")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
 	return nil
 }
 
+// GetMetaData get a meta-data value from the build of the job, returns a NotFoundError if the key isn't set
+func (ab *AgentAPI) GetMetaData(agentConfig *api.Agent, jobID string, key string) (string, error) {
+	defer telemetry.MeasureSince("getmetadata", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	metaData, res, err := client.MetaData.Get(jobID, key)
+	err = checkResponse(res, err)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get meta-data")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return metaData.Value, nil
+}
+
+// CreateAnnotation annotate the build of the job, annotations with the same context are replaced unless
+// they are appended
+func (ab *AgentAPI) CreateAnnotation(agentConfig *api.Agent, jobID string, annotation *api.Annotation) error {
+	defer telemetry.MeasureSince("createannotation", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	res, err := client.Annotations.Create(jobID, annotation)
+	err = checkResponse(res, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to create annotation")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return nil
+}
+
+// CreateArtifacts create a batch of artifacts for the job
+func (ab *AgentAPI) CreateArtifacts(agentConfig *api.Agent, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	defer telemetry.MeasureSince("createartifacts", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	createRes, res, err := client.Artifacts.Create(jobID, batch)
+	err = checkResponse(res, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create artifacts")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return createRes, nil
+}
+
+// UpdateArtifacts update the state of the artifacts for the job, the states are keyed by artifact id
+func (ab *AgentAPI) UpdateArtifacts(agentConfig *api.Agent, jobID string, artifactStates map[string]string) error {
+	defer telemetry.MeasureSince("updateartifacts", time.Now())
+
+	client := ab.agentClient(agentConfig)
+
+	res, err := client.Artifacts.Update(jobID, artifactStates)
+	err = checkResponse(res, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to update artifacts")
+	}
+	defer telemetry.ReportAPIResponse(res)
+
+	return nil
+}
+
+// agentClient return a client for the agent, this uses the endpoint returned by buildkite when the
+// agent was registered falling back to the configured endpoint
+func (ab *AgentAPI) agentClient(agentConfig *api.Agent) *api.Client {
+	endpoint := agentConfig.Endpoint
+	if endpoint == "" {
+		endpoint = ab.endpoint
+	}
+
+	return ab.client(agentConfig.Name, endpoint, agentConfig.AccessToken)
+}
+
+// client return the cached client for the agent, the client is replaced when the agent is given a new token or
+// endpoint, such as when the token is rotated, so only one client is kept per agent
+func (ab *AgentAPI) client(name, endpoint, token string) *api.Client {
+	ab.clientsMu.Lock()
+	defer ab.clientsMu.Unlock()
+
+	cached, ok := ab.clients[name]
+	if ok && cached.endpoint == endpoint && cached.token == token {
+		return cached.client
+	}
+
+	client := ab.newClient(endpoint, token)
+
+	ab.clients[name] = &cachedClient{endpoint: endpoint, token: token, client: client}
+
+	return client
+}
+
+func (ab *AgentAPI) newClient(endpoint, token string) *api.Client {
+	return newAgent(endpoint, token, &http.Client{
+		Transport: &api.AuthenticatedTransport{Token: token, Transport: ab.transport},
+		Timeout:   ab.timeout,
+	})
+}
+
 // enables overriding of the user agent to ensure this agent is recongised as a
 // seperate project.
-func newAgent(agentKey string) *api.Client {
-	client := agent.APIClient{Endpoint: DefaultAPIEndpoint, Token: agentKey}.Create()
+func newAgent(endpoint string, token string, httpClient *http.Client) *api.Client {
+	client := api.NewClient(httpClient)
+	client.BaseURL, _ = url.Parse(endpoint)
 	client.UserAgent = fmt.Sprintf("buildkite-serverless-agent/%s_%s (%s; %s)", Version, BuildVersion, runtime.GOOS, runtime.GOARCH)
 	return client
 }
+
+// newTransport http transport shared by all the buildkite clients, if no proxy is configured
+// the standard proxy environment variables are used
+func newTransport(cfg *config.Config) *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if cfg.HTTPProxy != "" {
+		proxyURL, err := url.Parse(cfg.HTTPProxy)
+		if err == nil {
+			proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.HTTPDialTimeout,
+			KeepAlive: cfg.HTTPKeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: cfg.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.HTTPIdleConnTimeout,
+		TLSHandshakeTimeout: cfg.HTTPDialTimeout,
+	}
+}
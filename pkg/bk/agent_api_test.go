@@ -0,0 +1,200 @@
+package bk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+)
+
+// fakeBuildkite records the requests made to a local buildkite agent api
+type fakeBuildkite struct {
+	requests []string
+	tokens   []string
+	bodies   []string
+	endpoint string
+}
+
+func (fb *fakeBuildkite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	fb.requests = append(fb.requests, r.URL.Path)
+	fb.tokens = append(fb.tokens, r.Header.Get("Authorization"))
+	fb.bodies = append(fb.bodies, string(body))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// buildkite only accepts the signal reasons it documents
+	if strings.HasSuffix(r.URL.Path, "/finish") {
+		finish := new(jobFinishRequest)
+		if json.Unmarshal(body, finish) == nil && !validSignalReason(finish.SignalReason) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message":"Signal reason is not included in the list"}`))
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case "/v3/jobs/abc123/finish":
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message":"Job has already finished"}`))
+	case "/v3/jobs/bad789/finish":
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message":"Exit status is invalid"}`))
+	case "/v3/heartbeat":
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"Invalid access token"}`))
+	case "/v3/register":
+		w.Write([]byte(`{"access_token":"token123","endpoint":"` + fb.endpoint + `"}`))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+func validSignalReason(signalReason string) bool {
+	switch signalReason {
+	case "", "agent_refused", "agent_stop", "cancel", "process_run_error", "signature_rejected":
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAgentAPI_Endpoint(t *testing.T) {
+
+	registerBK := &fakeBuildkite{}
+	registerSrv := httptest.NewServer(registerBK)
+	defer registerSrv.Close()
+
+	agentBK := &fakeBuildkite{}
+	agentSrv := httptest.NewServer(agentBK)
+	defer agentSrv.Close()
+
+	// buildkite returns the endpoint the agent should use
+	registerBK.endpoint = agentSrv.URL + "/v3"
+
+	ab := NewAgentAPI(&config.Config{AgentEndpoint: registerSrv.URL + "/v3"})
+
+	agentConfig, err := ab.Register("deployer-dev-1", "abc123", []string{"queue=dev"}, "")
+	require.Nil(t, err)
+	require.Equal(t, "token123", agentConfig.AccessToken)
+	require.Equal(t, []string{"/v3/register"}, registerBK.requests)
+	require.Equal(t, []string{"Token abc123"}, registerBK.tokens)
+
+	_, err = ab.Ping(agentConfig)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/v3/ping"}, agentBK.requests)
+	require.Equal(t, []string{"Token token123"}, agentBK.tokens)
+
+	// agents without an endpoint use the configured endpoint
+	_, err = ab.Ping(&api.Agent{AccessToken: "token456"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/v3/register", "/v3/ping"}, registerBK.requests)
+	require.Equal(t, []string{"Token abc123", "Token token456"}, registerBK.tokens)
+}
+
+func TestAgentAPI_FinishJob(t *testing.T) {
+
+	fb := &fakeBuildkite{}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	ab := NewAgentAPI(&config.Config{AgentEndpoint: srv.URL + "/v3"})
+
+	err := ab.FinishJob(&api.Agent{AccessToken: "token123"}, &api.Job{ID: "def456", ExitStatus: "-2"}, SignalReasonProcessRunError)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/v3/jobs/def456/finish"}, fb.requests)
+
+	finish := new(jobFinishRequest)
+	require.Nil(t, json.Unmarshal([]byte(fb.bodies[0]), finish))
+	require.Equal(t, "-2", finish.ExitStatus)
+	require.Equal(t, "process_run_error", finish.SignalReason)
+	require.NotEmpty(t, finish.FinishedAt)
+}
+
+func TestAgentAPI_FinishJob_Rejected(t *testing.T) {
+
+	fb := &fakeBuildkite{}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	ab := NewAgentAPI(&config.Config{AgentEndpoint: srv.URL + "/v3"})
+
+	// free text signal reasons are rejected, this isn't mistaken for a job which has already finished
+	err := ab.FinishJob(&api.Agent{AccessToken: "token123"}, &api.Job{ID: "def456", ExitStatus: "-2"}, "PRE_BUILD phase FAILED")
+	require.Error(t, err)
+	require.False(t, IsJobAlreadyFinished(err))
+
+	apiErr, ok := errors.Cause(err).(*APIError)
+	require.True(t, ok)
+	require.Equal(t, http.StatusUnprocessableEntity, apiErr.StatusCode)
+	require.Equal(t, "Signal reason is not included in the list", apiErr.Message)
+	require.False(t, IsRetryable(err))
+}
+
+func TestAgentAPI_client(t *testing.T) {
+
+	ab := NewAgentAPI(&config.Config{})
+	require.Equal(t, DefaultAPIEndpoint, ab.endpoint)
+
+	client := ab.agentClient(&api.Agent{Name: "buildkite-dev-1", AccessToken: "token123"})
+	require.Equal(t, DefaultAPIEndpoint, client.BaseURL.String())
+
+	// clients are reused per agent
+	require.True(t, client == ab.agentClient(&api.Agent{Name: "buildkite-dev-1", AccessToken: "token123"}))
+	require.False(t, client == ab.agentClient(&api.Agent{Name: "buildkite-dev-2", AccessToken: "token123"}))
+	require.Len(t, ab.clients, 2)
+
+	// the client is replaced when the token or endpoint of the agent changes
+	rotated := ab.agentClient(&api.Agent{Name: "buildkite-dev-1", AccessToken: "token456"})
+	require.False(t, client == rotated)
+	require.True(t, rotated == ab.agentClient(&api.Agent{Name: "buildkite-dev-1", AccessToken: "token456"}))
+	require.False(t, rotated == ab.agentClient(&api.Agent{Name: "buildkite-dev-1", AccessToken: "token456", Endpoint: "http://localhost:8080/v3"}))
+	require.Len(t, ab.clients, 2)
+}
+
+func TestAgentAPI_Errors(t *testing.T) {
+
+	srv := httptest.NewServer(&fakeBuildkite{})
+	defer srv.Close()
+
+	ab := NewAgentAPI(&config.Config{AgentEndpoint: srv.URL + "/v3"})
+
+	agentConfig := &api.Agent{AccessToken: "token123"}
+
+	_, err := ab.Beat(agentConfig)
+	require.Error(t, err)
+
+	unauthorized, ok := errors.Cause(err).(*UnauthorizedError)
+	require.True(t, ok)
+	require.Equal(t, 401, unauthorized.StatusCode)
+	require.Equal(t, "Invalid access token", unauthorized.Message)
+	require.Equal(t, `{"message":"Invalid access token"}`, string(unauthorized.Body))
+	require.False(t, IsRetryable(err))
+
+	err = ab.FinishJob(agentConfig, &api.Job{ID: "abc123"}, "")
+	require.Error(t, err)
+
+	finished, ok := errors.Cause(err).(*JobAlreadyFinishedError)
+	require.True(t, ok)
+	require.Equal(t, 422, finished.StatusCode)
+	require.Equal(t, `{"message":"Job has already finished"}`, string(finished.Body))
+	require.True(t, IsJobAlreadyFinished(err))
+
+	// other validation failures are returned as api errors
+	err = ab.FinishJob(agentConfig, &api.Job{ID: "bad789", ExitStatus: "abc"}, "")
+	require.Error(t, err)
+	require.False(t, IsJobAlreadyFinished(err))
+
+	invalid, ok := errors.Cause(err).(*APIError)
+	require.True(t, ok)
+	require.Equal(t, 422, invalid.StatusCode)
+	require.Equal(t, "Exit status is invalid", invalid.Message)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/codebuild"
@@ -25,6 +26,30 @@ const (
 	DefaultWaitTime = 10
 )
 
+const (
+	// ExitStatusSucceeded the codebuild build succeeded
+	ExitStatusSucceeded = "0"
+
+	// ExitStatusCanceled the job was canceled in buildkite and the codebuild build, if any, was stopped
+	ExitStatusCanceled = "-1"
+
+	// ExitStatusFailed the codebuild build failed
+	ExitStatusFailed = "-2"
+
+	// ExitStatusStopped the codebuild build was stopped
+	ExitStatusStopped = "-3"
+
+	// ExitStatusUnknown the codebuild build finished with an unknown status
+	ExitStatusUnknown = "-4"
+
+	// ExitStatusMissingBuild the codebuild build information is missing from the workflow
+	ExitStatusMissingBuild = "-5"
+
+	// ExitStatusTimedOut the job exceeded its timeout and the codebuild build was stopped, or codebuild stopped the
+	// build as it exceeded the build timeout
+	ExitStatusTimedOut = "-6"
+)
+
 var (
 	// Version the serverless agent version
 	Version = "dev"
@@ -35,14 +60,27 @@ var (
 
 // WorkflowData this is information passed along in the step function workflow
 type WorkflowData struct {
-	Job         *api.Job               `json:"job,omitempty"` // buildkite job
-	WaitTime    int                    `json:"wait_time,omitempty"`
-	NextToken   string                 `json:"next_token,omitempty"`
-	LogBytes    int                    `json:"log_bytes,omitempty"`    // used for cloudwatch log streaming
-	LogSequence int                    `json:"log_sequence,omitempty"` // used for cloudwatch log streaming
-	AgentName   string                 `json:"agent_name,omitempty"`
-	Codebuild   *CodebuildWorkflowData `json:"codebuild,omitempty"`
-	TaskStatus  string                 `json:"task_status,omitempty"`
+	SchemaVersion int `json:"schema_version"` // upgraded to WorkflowSchemaVersion when loaded
+
+	Job          *api.Job               `json:"job,omitempty"` // buildkite job
+	WaitTime     int                    `json:"wait_time,omitempty"`
+	NextToken    string                 `json:"next_token,omitempty"`
+	LogBytes     int                    `json:"log_bytes,omitempty"`    // used for cloudwatch log streaming
+	LogSequence  int                    `json:"log_sequence,omitempty"` // used for cloudwatch log streaming
+	AgentName    string                 `json:"agent_name,omitempty"`
+	JobRef       string                 `json:"job_ref,omitempty"`        // reference to the job in the workflow store, replaces the job
+	AgentTokenID string                 `json:"agent_token_id,omitempty"` // identifies the access token the job was accepted with
+	Codebuild    *CodebuildWorkflowData `json:"codebuild,omitempty"`
+	TaskStatus   string                 `json:"task_status,omitempty"`
+	TaskError    *TaskError             `json:"task_error,omitempty"` // error caught by the state machine before the job is completed
+	Cancelled    bool                   `json:"cancelled,omitempty"`  // the job was canceled in buildkite
+	TimedOut     bool                   `json:"timed_out,omitempty"`  // the job exceeded its timeout
+}
+
+// TaskError the error and cause of a failed task, as written by the catchers of the state machine
+type TaskError struct {
+	Error string `json:"Error"`
+	Cause string `json:"Cause"`
 }
 
 // CodebuildWorkflowData codebuild workflow info
@@ -55,6 +93,25 @@ type CodebuildWorkflowData struct {
 	LogStreamPrefix string `json:"log_stream_prefix,omitempty"`
 }
 
+// UploadMessage upload a message to the job log
+func (evt *WorkflowData) UploadMessage(buildkiteAPI API, agentConfig *api.Agent, msg string) error {
+	err := buildkiteAPI.ChunksUpload(agentConfig, evt.Job.ID, &api.Chunk{
+		Data:     msg,
+		Sequence: evt.LogSequence,
+		Offset:   evt.LogBytes,
+		Size:     len(msg),
+	})
+	if err != nil {
+		return err
+	}
+
+	// increment everything
+	evt.LogSequence++
+	evt.LogBytes += len(msg)
+
+	return nil
+}
+
 // UpdateJobExitCode update the exit code of the buildkite job using info from codebuild
 func (evt *WorkflowData) UpdateJobExitCode() error {
 
@@ -62,26 +119,89 @@ func (evt *WorkflowData) UpdateJobExitCode() error {
 		return errors.New("job is missing in workflow event")
 	}
 
+	if evt.Cancelled {
+		evt.Job.ExitStatus = ExitStatusCanceled
+		return nil
+	}
+
+	if evt.TimedOut {
+		evt.Job.ExitStatus = ExitStatusTimedOut
+		return nil
+	}
+
 	// this is currently defaulted as error cases may result in this being empty
 	if evt.Codebuild == nil {
-		evt.Job.ExitStatus = "-5"
+		evt.Job.ExitStatus = ExitStatusMissingBuild
 		return nil
 	}
 
 	switch evt.Codebuild.BuildStatus {
 	case codebuild.StatusTypeStopped:
-		evt.Job.ExitStatus = "-3"
+		evt.Job.ExitStatus = ExitStatusStopped
 	case codebuild.StatusTypeFailed:
-		evt.Job.ExitStatus = "-2"
+		evt.Job.ExitStatus = ExitStatusFailed
 	case codebuild.StatusTypeSucceeded:
-		evt.Job.ExitStatus = "0"
+		evt.Job.ExitStatus = ExitStatusSucceeded
+	case codebuild.StatusTypeTimedOut:
+		evt.Job.ExitStatus = ExitStatusTimedOut
 	default:
-		evt.Job.ExitStatus = "-4"
+		evt.Job.ExitStatus = ExitStatusUnknown
 	}
 
 	return nil
 }
 
+// BuildTimedOut did codebuild stop the build as it exceeded the build timeout
+func (evt *WorkflowData) BuildTimedOut() bool {
+	return evt.Codebuild != nil && evt.Codebuild.BuildStatus == codebuild.StatusTypeTimedOut
+}
+
+// JobTimeout the timeout assigned to the job in the pipeline, buildkite passes this in minutes using the
+// BUILDKITE_TIMEOUT environment variable which is false if there isn't a timeout, returns zero if there isn't one
+func (evt *WorkflowData) JobTimeout() time.Duration {
+	minutes, err := strconv.Atoi(evt.Job.Env["BUILDKITE_TIMEOUT"])
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// JobTimedOut has the job been running for longer than its timeout, this uses the time the job was started
+func (evt *WorkflowData) JobTimedOut(now time.Time) bool {
+	timeout := evt.JobTimeout()
+	if timeout == 0 {
+		return false
+	}
+
+	startedAt, err := time.Parse(time.RFC3339Nano, evt.Job.StartedAt)
+	if err != nil {
+		return false
+	}
+
+	return now.Sub(startedAt) > timeout
+}
+
+// ArtifactPrefix prefix of the keys in the artifact bucket where the build writes the artifacts for the job
+func ArtifactPrefix(jobID string) string {
+	return fmt.Sprintf("artifacts/%s/", jobID)
+}
+
+// UpdateArtifactPrefix assign the artifact prefix for the job to the environment variables of the job
+func (evt *WorkflowData) UpdateArtifactPrefix() {
+	evt.Job.Env["ARTIFACT_PREFIX"] = ArtifactPrefix(evt.Job.ID)
+}
+
+// ExitStatusKey key in the artifact bucket where the build writes the exit status of the command run for the job
+func ExitStatusKey(jobID string) string {
+	return fmt.Sprintf("exit-status/%s", jobID)
+}
+
+// UpdateExitStatusKey assign the exit status key for the job to the environment variables of the job
+func (evt *WorkflowData) UpdateExitStatusKey() {
+	evt.Job.Env["EXIT_STATUS_KEY"] = ExitStatusKey(evt.Job.ID)
+}
+
 // UpdateEnvironment assign the environment variables to the job
 func (evt *WorkflowData) UpdateEnvironment(environmentName string, environmentNumber string) {
 
@@ -166,12 +286,19 @@ func (evt *WorkflowData) GetBuildkitePipelineEnvString() string {
 
 // API wrap up all the buildkite api operations
 type API interface {
-	Register(string, string, []string) (*api.Agent, error)
-	Beat(string) (*api.Heartbeat, error)
-	Ping(string) (*api.Ping, error)
-	AcceptJob(string, *api.Job) (*api.Job, error)
-	StartJob(string, *api.Job) error
-	FinishJob(string, *api.Job) error
-	GetStateJob(string, string) (*api.JobState, error)
-	ChunksUpload(string, string, *api.Chunk) error
+	Register(string, string, []string, string) (*api.Agent, error)
+	Connect(*api.Agent) error
+	Disconnect(*api.Agent) error
+	Beat(*api.Agent) (*api.Heartbeat, error)
+	Ping(*api.Agent) (*api.Ping, error)
+	AcceptJob(*api.Agent, *api.Job) (*api.Job, error)
+	StartJob(*api.Agent, *api.Job) error
+	FinishJob(*api.Agent, *api.Job, string) error
+	GetStateJob(*api.Agent, string) (*api.JobState, error)
+	ChunksUpload(*api.Agent, string, *api.Chunk) error
+	SetMetaData(*api.Agent, string, string, string) error
+	GetMetaData(*api.Agent, string, string) (string, error)
+	CreateAnnotation(*api.Agent, string, *api.Annotation) error
+	CreateArtifacts(*api.Agent, string, *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error)
+	UpdateArtifacts(*api.Agent, string, map[string]string) error
 }
@@ -2,6 +2,7 @@ package bk
 
 import (
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/buildkite/agent/api"
@@ -14,6 +15,8 @@ func TestWorkflowData_UpdateJobExitCode(t *testing.T) {
 	type fields struct {
 		Codebuild *CodebuildWorkflowData
 		Job       *api.Job
+		Cancelled bool
+		TimedOut  bool
 	}
 	type results struct {
 		exitCode          string
@@ -35,21 +38,30 @@ func TestWorkflowData_UpdateJobExitCode(t *testing.T) {
 			wantErr: false,
 		},
 		{
-			name: "check failed results in exitcode -1",
+			name: "check failed results in exitcode -2",
 			fields: fields{
 				Codebuild: &CodebuildWorkflowData{BuildStatus: codebuild.StatusTypeFailed},
 				Job:       &api.Job{},
 			},
-			want:    results{exitCode: "-1", chunksFailedCount: 0},
+			want:    results{exitCode: ExitStatusFailed, chunksFailedCount: 0},
 			wantErr: false,
 		},
 		{
-			name: "check stopped results in exitcode -2",
+			name: "check stopped results in exitcode -3",
 			fields: fields{
 				Codebuild: &CodebuildWorkflowData{BuildStatus: codebuild.StatusTypeStopped},
 				Job:       &api.Job{},
 			},
-			want:    results{exitCode: "-2", chunksFailedCount: 0},
+			want:    results{exitCode: ExitStatusStopped, chunksFailedCount: 0},
+			wantErr: false,
+		},
+		{
+			name: "check codebuild timed out results in exitcode -6",
+			fields: fields{
+				Codebuild: &CodebuildWorkflowData{BuildStatus: codebuild.StatusTypeTimedOut},
+				Job:       &api.Job{},
+			},
+			want:    results{exitCode: ExitStatusTimedOut, chunksFailedCount: 0},
 			wantErr: false,
 		},
 		{
@@ -60,18 +72,39 @@ func TestWorkflowData_UpdateJobExitCode(t *testing.T) {
 			want:    results{exitCode: "-5", chunksFailedCount: 0},
 			wantErr: false,
 		},
+		{
+			name: "check cancelled job results in exitcode -1",
+			fields: fields{
+				Codebuild: &CodebuildWorkflowData{BuildStatus: codebuild.StatusTypeStopped},
+				Job:       &api.Job{},
+				Cancelled: true,
+			},
+			want:    results{exitCode: ExitStatusCanceled, chunksFailedCount: 0},
+			wantErr: false,
+		},
+		{
+			name: "check timed out job results in exitcode -6",
+			fields: fields{
+				Codebuild: &CodebuildWorkflowData{BuildStatus: codebuild.StatusTypeStopped},
+				Job:       &api.Job{},
+				TimedOut:  true,
+			},
+			want:    results{exitCode: ExitStatusTimedOut, chunksFailedCount: 0},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			evt := &WorkflowData{
 				Codebuild: tt.fields.Codebuild,
 				Job:       tt.fields.Job,
+				Cancelled: tt.fields.Cancelled,
+				TimedOut:  tt.fields.TimedOut,
 			}
-			if err := evt.UpdateJobExitCode(); (err != nil) != tt.wantErr {
-				require.Equal(t, tt.want.exitCode, evt.Job.ExitStatus)
-				require.Equal(t, tt.want.chunksFailedCount, evt.Job.ChunksFailedCount)
-				t.Errorf("WorkflowData.UpdateJobExitCode() error = %v, wantErr %v", err, tt.wantErr)
-			}
+			err := evt.UpdateJobExitCode()
+			require.Equal(t, tt.wantErr, err != nil)
+			require.Equal(t, tt.want.exitCode, evt.Job.ExitStatus)
+			require.Equal(t, tt.want.chunksFailedCount, evt.Job.ChunksFailedCount)
 
 		})
 	}
@@ -121,3 +154,44 @@ func TestWorkflowData_UpdateCodebuildStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWorkflowData_JobTimedOut(t *testing.T) {
+
+	startedAt := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		now         time.Time
+		wantTimeout time.Duration
+		want        bool
+	}{
+		{
+			name: "job without a timeout",
+			env:  map[string]string{"BUILDKITE_TIMEOUT": "false"},
+			now:  startedAt.Add(24 * time.Hour),
+		},
+		{
+			name:        "job within its timeout",
+			env:         map[string]string{"BUILDKITE_TIMEOUT": "10"},
+			now:         startedAt.Add(9 * time.Minute),
+			wantTimeout: 10 * time.Minute,
+		},
+		{
+			name:        "job which exceeded its timeout",
+			env:         map[string]string{"BUILDKITE_TIMEOUT": "10"},
+			now:         startedAt.Add(11 * time.Minute),
+			wantTimeout: 10 * time.Minute,
+			want:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evt := &WorkflowData{
+				Job: &api.Job{Env: tt.env, StartedAt: startedAt.Format(time.RFC3339Nano)},
+			}
+			require.Equal(t, tt.wantTimeout, evt.JobTimeout())
+			require.Equal(t, tt.want, evt.JobTimedOut(tt.now))
+		})
+	}
+}
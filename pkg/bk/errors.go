@@ -0,0 +1,196 @@
+package bk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+)
+
+// maximum size of an error response body which is kept
+const maxErrorBodySize = 64 * 1024
+
+// APIError returned when a call to the buildkite agent api fails, network errors have no status code
+type APIError struct {
+	StatusCode int
+	Message    string
+	Body       []byte        // body of the error response
+	RetryAfter time.Duration // how long buildkite asked us to wait before trying again
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Err.Error()
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("buildkite returned status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("buildkite returned status %d", e.StatusCode)
+}
+
+// Retryable can the call be repeated, this is true for network errors, rate limiting and server errors
+func (e *APIError) Retryable() bool {
+	if e.StatusCode == 0 {
+		_, ok := e.Err.(net.Error)
+		return ok
+	}
+
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (e *APIError) apiError() *APIError {
+	return e
+}
+
+// UnauthorizedError buildkite rejected the access token, the agent needs to be registered again
+type UnauthorizedError struct {
+	*APIError
+}
+
+// NotFoundError the job or agent doesn't exist in buildkite
+type NotFoundError struct {
+	*APIError
+}
+
+// JobAlreadyFinishedError buildkite rejected the call to finish the job as it has already finished
+type JobAlreadyFinishedError struct {
+	*APIError
+}
+
+// NetworkError buildkite couldn't be reached
+type NetworkError struct {
+	*APIError
+}
+
+// AsAPIError return the buildkite api error which caused the error
+func AsAPIError(err error) (*APIError, bool) {
+	e, ok := errors.Cause(err).(interface{ apiError() *APIError })
+	if !ok {
+		return nil, false
+	}
+	return e.apiError(), true
+}
+
+// IsJobAlreadyFinished did buildkite reject the call to finish the job because it has already finished, this happens
+// when a step is retried after the job was finished
+func IsJobAlreadyFinished(err error) bool {
+	_, ok := errors.Cause(err).(*JobAlreadyFinishedError)
+	return ok
+}
+
+// IsRetryable is the cause of the error a buildkite api error which can be retried
+func IsRetryable(err error) bool {
+	apiErr, ok := AsAPIError(err)
+	return ok && apiErr.Retryable()
+}
+
+// checkResponse convert the result of a buildkite api call to an APIError, or one of the more specific errors
+func checkResponse(res *api.Response, err error) error {
+	var httpRes *http.Response
+
+	apiErr := &APIError{Err: err}
+
+	switch e := err.(type) {
+	case nil:
+		if res == nil || res.StatusCode <= 299 {
+			return nil
+		}
+		httpRes = res.Response
+		apiErr.Message = res.Status
+	case *api.ErrorResponse:
+		httpRes = e.Response
+		apiErr.Message = e.Message
+	}
+
+	if httpRes != nil {
+		apiErr.StatusCode = httpRes.StatusCode
+		apiErr.Body = errorBody(httpRes)
+		apiErr.RetryAfter = retryAfter(httpRes.Header)
+	}
+
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized:
+		return &UnauthorizedError{apiErr}
+	case apiErr.StatusCode == http.StatusNotFound:
+		return &NotFoundError{apiErr}
+	case apiErr.StatusCode == 0 && apiErr.Retryable():
+		return &NetworkError{apiErr}
+	}
+
+	return apiErr
+}
+
+// retryAfter parse the Retry-After header which is either a number of seconds or a date
+func retryAfter(header http.Header) time.Duration {
+	val := header.Get("Retry-After")
+	if val == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// errorBodyTransport records the body of error responses, the buildkite client only keeps the message
+type errorBodyTransport struct {
+	next http.RoundTripper
+}
+
+func (t *errorBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode > 299 {
+		res.Body = &recordedBody{ReadCloser: res.Body}
+	}
+
+	return res, nil
+}
+
+// recordedBody keeps a copy of the body as it is read
+type recordedBody struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (rb *recordedBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+
+	// only the start of large bodies is kept
+	keep := n
+	if remaining := maxErrorBodySize - rb.buf.Len(); keep > remaining {
+		keep = remaining
+	}
+	rb.buf.Write(p[:keep])
+
+	return n, err
+}
+
+// errorBody return the body of the error response if it was recorded
+func errorBody(res *http.Response) []byte {
+	if res == nil {
+		return nil
+	}
+	if rb, ok := res.Body.(*recordedBody); ok {
+		return rb.buf.Bytes()
+	}
+	return nil
+}
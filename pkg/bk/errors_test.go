@@ -0,0 +1,80 @@
+package bk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkResponse(t *testing.T) {
+
+	tooManyRequests := &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": []string{"7"}}}
+
+	tests := []struct {
+		name          string
+		res           *api.Response
+		err           error
+		want          *APIError
+		wantRetryable bool
+	}{
+		{
+			name: "checkResponse() with success",
+			res:  &api.Response{Response: &http.Response{StatusCode: 200}},
+		},
+		{
+			name:          "checkResponse() with rate limit",
+			res:           &api.Response{Response: tooManyRequests},
+			err:           &api.ErrorResponse{Response: tooManyRequests, Message: "slow down"},
+			want:          &APIError{StatusCode: 429, Message: "slow down", RetryAfter: 7 * time.Second},
+			wantRetryable: true,
+		},
+		{
+			name:          "checkResponse() with unchecked status",
+			res:           &api.Response{Response: &http.Response{StatusCode: 502, Status: "502 Bad Gateway"}},
+			want:          &APIError{StatusCode: 502, Message: "502 Bad Gateway"},
+			wantRetryable: true,
+		},
+		{
+			name:          "checkResponse() with decode error",
+			res:           &api.Response{Response: &http.Response{StatusCode: 200}},
+			err:           errors.New("unexpected EOF"),
+			want:          &APIError{},
+			wantRetryable: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResponse(tt.res, tt.err)
+			if tt.want == nil {
+				require.Nil(t, err)
+				return
+			}
+
+			apiErr, ok := err.(*APIError)
+			require.True(t, ok)
+			require.Equal(t, tt.want.StatusCode, apiErr.StatusCode)
+			require.Equal(t, tt.want.Message, apiErr.Message)
+			require.Equal(t, tt.want.RetryAfter, apiErr.RetryAfter)
+			require.Equal(t, tt.wantRetryable, IsRetryable(errors.Wrap(err, "failed")))
+		})
+	}
+}
+
+func Test_recordedBody(t *testing.T) {
+
+	body := bytes.Repeat([]byte("a"), maxErrorBodySize+100)
+
+	rb := &recordedBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(body))}
+
+	// the whole body is read but only the start is kept
+	data, err := ioutil.ReadAll(rb)
+	require.Nil(t, err)
+	require.Equal(t, body, data)
+	require.Equal(t, body[:maxErrorBodySize], errorBody(&http.Response{Body: rb}))
+}
@@ -0,0 +1,210 @@
+package bk
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy how calls to the buildkite api which are safe to repeat are retried
+type RetryPolicy struct {
+	MaxAttempts int
+	MinDelay    time.Duration
+	MaxDelay    time.Duration // calls are not retried if buildkite asks us to wait longer than this
+	MaxElapsed  time.Duration // calls are not retried once the next attempt would start after this, zero disables the limit
+}
+
+// DefaultRetryPolicy retry policy for the 30 second timeout of the step function lambdas, no attempt starts after 15
+// seconds so with the default 10 second http timeout a call, including retries, takes at most 25 seconds
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	MinDelay:    500 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	MaxElapsed:  15 * time.Second,
+}
+
+// delay exponential backoff for the given attempt, starting at zero
+func (rp RetryPolicy) delay(attempt int) time.Duration {
+	d := rp.MinDelay << uint(attempt)
+	if d > rp.MaxDelay || d <= 0 {
+		return rp.MaxDelay
+	}
+	return d
+}
+
+// RetryAPI retries calls to the buildkite api which are safe to repeat, register, accept job, start job and
+// create artifacts fail fast with an APIError
+type RetryAPI struct {
+	next   API
+	policy RetryPolicy
+	sleep  func(time.Duration)
+	now    func() time.Time
+}
+
+// NewRetryAPI wrap the buildkite api with the retry policy
+func NewRetryAPI(next API, policy RetryPolicy) *RetryAPI {
+	return &RetryAPI{
+		next:   next,
+		policy: policy,
+		sleep:  time.Sleep,
+		now:    time.Now,
+	}
+}
+
+// Register register an agent, this is not retried
+func (ra *RetryAPI) Register(agentName string, agentKey string, tags []string, priority string) (*api.Agent, error) {
+	return ra.next.Register(agentName, agentKey, tags, priority)
+}
+
+// Connect connect the agent to the agent api
+func (ra *RetryAPI) Connect(agentConfig *api.Agent) error {
+	return ra.retry("connect", func() error {
+		return ra.next.Connect(agentConfig)
+	})
+}
+
+// Disconnect disconnect the agent from the agent api
+func (ra *RetryAPI) Disconnect(agentConfig *api.Agent) error {
+	return ra.retry("disconnect", func() error {
+		return ra.next.Disconnect(agentConfig)
+	})
+}
+
+// Beat send a heartbeat to the agent api
+func (ra *RetryAPI) Beat(agentConfig *api.Agent) (*api.Heartbeat, error) {
+	var heartbeat *api.Heartbeat
+
+	err := ra.retry("beat", func() (err error) {
+		heartbeat, err = ra.next.Beat(agentConfig)
+		return err
+	})
+
+	return heartbeat, err
+}
+
+// Ping ping the agent api for a job
+func (ra *RetryAPI) Ping(agentConfig *api.Agent) (*api.Ping, error) {
+	var ping *api.Ping
+
+	err := ra.retry("ping", func() (err error) {
+		ping, err = ra.next.Ping(agentConfig)
+		return err
+	})
+
+	return ping, err
+}
+
+// AcceptJob accept the job provided by buildkite, this is not retried
+func (ra *RetryAPI) AcceptJob(agentConfig *api.Agent, job *api.Job) (*api.Job, error) {
+	return ra.next.AcceptJob(agentConfig, job)
+}
+
+// StartJob start the job provided by buildkite, this is not retried
+func (ra *RetryAPI) StartJob(agentConfig *api.Agent, job *api.Job) error {
+	return ra.next.StartJob(agentConfig, job)
+}
+
+// FinishJob finish the job provided by buildkite
+func (ra *RetryAPI) FinishJob(agentConfig *api.Agent, job *api.Job, signalReason string) error {
+	return ra.retry("finishjob", func() error {
+		return ra.next.FinishJob(agentConfig, job, signalReason)
+	})
+}
+
+// GetStateJob get the state of the job
+func (ra *RetryAPI) GetStateJob(agentConfig *api.Agent, jobID string) (*api.JobState, error) {
+	var jobState *api.JobState
+
+	err := ra.retry("getstatejob", func() (err error) {
+		jobState, err = ra.next.GetStateJob(agentConfig, jobID)
+		return err
+	})
+
+	return jobState, err
+}
+
+// ChunksUpload upload chunk of log data, buildkite uses the sequence number to discard duplicate chunks
+func (ra *RetryAPI) ChunksUpload(agentConfig *api.Agent, jobID string, chunk *api.Chunk) error {
+	return ra.retry("chunkUpload", func() error {
+		return ra.next.ChunksUpload(agentConfig, jobID, chunk)
+	})
+}
+
+// SetMetaData set a meta-data value on the build of the job
+func (ra *RetryAPI) SetMetaData(agentConfig *api.Agent, jobID string, key string, value string) error {
+	return ra.retry("setmetadata", func() error {
+		return ra.next.SetMetaData(agentConfig, jobID, key, value)
+	})
+}
+
+// GetMetaData get a meta-data value from the build of the job
+func (ra *RetryAPI) GetMetaData(agentConfig *api.Agent, jobID string, key string) (string, error) {
+	var value string
+
+	err := ra.retry("getmetadata", func() (err error) {
+		value, err = ra.next.GetMetaData(agentConfig, jobID, key)
+		return err
+	})
+
+	return value, err
+}
+
+// CreateAnnotation annotate the build of the job, appended annotations are not retried as they aren't replaced
+func (ra *RetryAPI) CreateAnnotation(agentConfig *api.Agent, jobID string, annotation *api.Annotation) error {
+	if annotation.Append {
+		return ra.next.CreateAnnotation(agentConfig, jobID, annotation)
+	}
+
+	return ra.retry("createannotation", func() error {
+		return ra.next.CreateAnnotation(agentConfig, jobID, annotation)
+	})
+}
+
+// CreateArtifacts create a batch of artifacts for the job, this is not retried
+func (ra *RetryAPI) CreateArtifacts(agentConfig *api.Agent, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	return ra.next.CreateArtifacts(agentConfig, jobID, batch)
+}
+
+// UpdateArtifacts update the state of the artifacts for the job
+func (ra *RetryAPI) UpdateArtifacts(agentConfig *api.Agent, jobID string, artifactStates map[string]string) error {
+	return ra.retry("updateartifacts", func() error {
+		return ra.next.UpdateArtifacts(agentConfig, jobID, artifactStates)
+	})
+}
+
+// retry call the function until it succeeds, returns an error which can't be retried or runs out of attempts
+func (ra *RetryAPI) retry(action string, fn func() error) error {
+	start := ra.now()
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		apiErr, ok := AsAPIError(err)
+		if !ok || !apiErr.Retryable() || attempt+1 >= ra.policy.MaxAttempts {
+			return err
+		}
+
+		delay := ra.policy.delay(attempt)
+		if apiErr.RetryAfter > ra.policy.MaxDelay {
+			return err
+		}
+		if apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		if ra.policy.MaxElapsed > 0 && ra.now().Add(delay).Sub(start) > ra.policy.MaxElapsed {
+			return err
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"action":  action,
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Warn("retrying buildkite api call")
+
+		ra.sleep(delay)
+	}
+}
@@ -0,0 +1,124 @@
+package bk
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
+)
+
+func TestRetryAPI_ChunksUpload(t *testing.T) {
+
+	netErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name       string
+		errs       []error
+		callTime   time.Duration
+		wantErr    bool
+		wantCalls  int
+		wantDelays []time.Duration
+	}{
+		{
+			name:      "ChunksUpload() succeeds",
+			errs:      []error{nil},
+			wantErr:   false,
+			wantCalls: 1,
+		},
+		{
+			name:       "ChunksUpload() retries server errors",
+			errs:       []error{&APIError{StatusCode: 502}, &APIError{StatusCode: 503}, nil},
+			wantErr:    false,
+			wantCalls:  3,
+			wantDelays: []time.Duration{500 * time.Millisecond, 1 * time.Second},
+		},
+		{
+			name:       "ChunksUpload() retries network errors",
+			errs:       []error{errors.Wrap(&APIError{Err: netErr}, "failed to upload chunk"), nil},
+			wantErr:    false,
+			wantCalls:  2,
+			wantDelays: []time.Duration{500 * time.Millisecond},
+		},
+		{
+			name:       "ChunksUpload() honours retry after",
+			errs:       []error{&APIError{StatusCode: 429, RetryAfter: 3 * time.Second}, nil},
+			wantErr:    false,
+			wantCalls:  2,
+			wantDelays: []time.Duration{3 * time.Second},
+		},
+		{
+			name:      "ChunksUpload() fails when retry after is too long",
+			errs:      []error{&APIError{StatusCode: 429, RetryAfter: time.Minute}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "ChunksUpload() fails fast on client errors",
+			errs:      []error{&APIError{StatusCode: 422}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:       "ChunksUpload() gives up after max attempts",
+			errs:       []error{&APIError{StatusCode: 500}, &APIError{StatusCode: 500}, &APIError{StatusCode: 500}, &APIError{StatusCode: 500}},
+			wantErr:    true,
+			wantCalls:  4,
+			wantDelays: []time.Duration{500 * time.Millisecond, 1 * time.Second, 2 * time.Second},
+		},
+		{
+			name:       "ChunksUpload() gives up when the next attempt would start after the max elapsed time",
+			errs:       []error{&APIError{StatusCode: 500}, &APIError{StatusCode: 500}},
+			callTime:   10 * time.Second,
+			wantErr:    true,
+			wantCalls:  2,
+			wantDelays: []time.Duration{500 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			now := time.Date(2019, 4, 20, 10, 0, 0, 0, time.UTC)
+
+			buildkiteAPI := &mocks.API{}
+
+			for _, err := range tt.errs {
+				buildkiteAPI.On("ChunksUpload", mock.AnythingOfType("*api.Agent"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(err).Once().Run(func(mock.Arguments) {
+					now = now.Add(tt.callTime)
+				})
+			}
+
+			var delays []time.Duration
+
+			ra := NewRetryAPI(buildkiteAPI, DefaultRetryPolicy)
+			ra.now = func() time.Time { return now }
+			ra.sleep = func(d time.Duration) {
+				delays = append(delays, d)
+				now = now.Add(d)
+			}
+
+			err := ra.ChunksUpload(&api.Agent{AccessToken: "token123"}, "abc123", &api.Chunk{Sequence: 1})
+			require.Equal(t, tt.wantErr, err != nil)
+			require.Equal(t, tt.wantDelays, delays)
+			buildkiteAPI.AssertNumberOfCalls(t, "ChunksUpload", tt.wantCalls)
+		})
+	}
+}
+
+func TestRetryAPI_AcceptJob(t *testing.T) {
+
+	buildkiteAPI := &mocks.API{}
+	buildkiteAPI.On("AcceptJob", mock.AnythingOfType("*api.Agent"), mock.AnythingOfType("*api.Job")).Return(nil, &APIError{StatusCode: 503})
+
+	ra := NewRetryAPI(buildkiteAPI, DefaultRetryPolicy)
+	ra.sleep = func(d time.Duration) { t.Fatal("accept job should not be retried") }
+
+	_, err := ra.AcceptJob(&api.Agent{AccessToken: "token123"}, &api.Job{ID: "abc123"})
+	require.Error(t, err)
+	require.True(t, IsRetryable(err))
+	buildkiteAPI.AssertNumberOfCalls(t, "AcceptJob", 1)
+}
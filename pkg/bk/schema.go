@@ -0,0 +1,91 @@
+package bk
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// WorkflowSchemaVersion the version of the workflow data written by the handlers, executions started by an older
+// release are upgraded to this version when the workflow data is loaded. Bump this and add an upgrade when removing,
+// renaming or changing the meaning of a field.
+const WorkflowSchemaVersion = 1
+
+// workflowUpgrade update the fields of the workflow data written using the previous schema version
+type workflowUpgrade func(fields map[string]json.RawMessage) error
+
+// workflowUpgrades upgrades indexed by the schema version they upgrade from
+var workflowUpgrades = map[int]workflowUpgrade{
+	0: upgradeTaskError,
+}
+
+// upgradeTaskError move the error written to the task status by the catchers of the state machine to the task
+// error, version 1 catchers write it there so the task status is always a string
+func upgradeTaskError(fields map[string]json.RawMessage) error {
+
+	raw, ok := fields["task_status"]
+	if !ok {
+		return nil
+	}
+
+	var taskStatus string
+
+	if json.Unmarshal(raw, &taskStatus) == nil {
+		return nil
+	}
+
+	fields["task_error"] = raw
+	delete(fields, "task_status")
+
+	return nil
+}
+
+// UnmarshalJSON load the workflow data upgrading it from the schema version it was written with
+func (evt *WorkflowData) UnmarshalJSON(data []byte) error {
+
+	fields := map[string]json.RawMessage{}
+
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal workflow data")
+	}
+
+	version := 0
+
+	if raw, ok := fields["schema_version"]; ok {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return errors.Wrap(err, "failed to unmarshal workflow data schema version")
+		}
+	}
+
+	// fields added by a newer release can't be understood so the execution fails rather than losing them
+	if version > WorkflowSchemaVersion {
+		return errors.Errorf("workflow data schema version %d is newer than the supported version %d", version, WorkflowSchemaVersion)
+	}
+
+	for ; version < WorkflowSchemaVersion; version++ {
+		upgrade, ok := workflowUpgrades[version]
+		if !ok {
+			return errors.Errorf("no upgrade for workflow data schema version %d", version)
+		}
+
+		err = upgrade(fields)
+		if err != nil {
+			return errors.Wrapf(err, "failed to upgrade workflow data schema version %d", version)
+		}
+	}
+
+	fields["schema_version"] = json.RawMessage(strconv.Itoa(WorkflowSchemaVersion))
+
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal upgraded workflow data")
+	}
+
+	// the alias doesn't have this method so it is decoded normally
+	type workflowData WorkflowData
+
+	return json.Unmarshal(data, (*workflowData)(evt))
+}
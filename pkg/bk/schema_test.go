@@ -0,0 +1,126 @@
+package bk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkflowData_UnmarshalJSON(t *testing.T) {
+
+	// the fields written by every schema version
+	base := func() *WorkflowData {
+		return &WorkflowData{
+			SchemaVersion: WorkflowSchemaVersion,
+			Job: &api.Job{
+				ID:                 "abc123",
+				Env:                map[string]string{"BUILDKITE_TIMEOUT": "30"},
+				ChunksMaxSizeBytes: 102400,
+			},
+			WaitTime:    10,
+			NextToken:   "nextToken",
+			LogBytes:    512,
+			LogSequence: 2,
+			AgentName:   "buildkite-dev-1",
+			Codebuild: &CodebuildWorkflowData{
+				BuildID:       "buildkite-dev-1:58df10ab",
+				BuildStatus:   "IN_PROGRESS",
+				ProjectName:   "buildkite-dev-1",
+				LogGroupName:  "/aws/codebuild/buildkite-dev-1",
+				LogStreamName: "58df10ab",
+			},
+			TaskStatus: "RUNNING",
+		}
+	}
+
+	taskError := &TaskError{Error: "UnauthorizedError", Cause: "failed to get task status: buildkite returned status 401"}
+
+	v0 := base()
+	v0.AgentTokenID = "7e5b1e4a2c9d0f31"
+	v0.Cancelled = true
+	v0.TimedOut = true
+	v0.TaskStatus = ""
+	v0.TaskError = taskError
+
+	v1 := base()
+	v1.AgentTokenID = "7e5b1e4a2c9d0f31"
+	v1.Cancelled = true
+	v1.TimedOut = true
+	v1.TaskError = taskError
+
+	tests := []struct {
+		name    string
+		version int
+		data    string // workflow data which doesn't have a golden file
+		want    *WorkflowData
+	}{
+		{
+			name:    "UnmarshalJSON() with workflow data written before the schema was versioned",
+			version: 0,
+			data:    `{"job":{"id":"abc123","env":{"BUILDKITE_TIMEOUT":"30"},"chunks_max_size_bytes":102400},"wait_time":10,"next_token":"nextToken","log_bytes":512,"log_sequence":2,"agent_name":"buildkite-dev-1","codebuild":{"build_id":"buildkite-dev-1:58df10ab","build_status":"IN_PROGRESS","project_name":"buildkite-dev-1","log_group_name":"/aws/codebuild/buildkite-dev-1","log_stream_name":"58df10ab"},"task_status":"RUNNING"}`,
+			want:    base(),
+		},
+		{
+			name:    "UnmarshalJSON() with version 0 workflow data with the error caught in the task status",
+			version: 0,
+			want:    v0,
+		},
+		{
+			name:    "UnmarshalJSON() with version 1 workflow data",
+			version: 1,
+			want:    v1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			if tt.data == "" {
+				data = goldenWorkflowData(t, tt.version)
+			}
+
+			got := new(WorkflowData)
+			require.Nil(t, json.Unmarshal(data, got))
+			require.Equal(t, tt.want, got)
+
+			// the current version is written exactly as recorded in the golden file, changes to the fields need a
+			// new schema version and golden file
+			if tt.data == "" && tt.version == WorkflowSchemaVersion {
+				written, err := json.Marshal(tt.want)
+				require.Nil(t, err)
+				require.JSONEq(t, string(data), string(written))
+			}
+		})
+	}
+}
+
+func TestWorkflowData_UnmarshalJSON_Newer(t *testing.T) {
+
+	data := []byte(fmt.Sprintf(`{"schema_version":%d,"agent_name":"buildkite-dev-1"}`, WorkflowSchemaVersion+1))
+
+	err := json.Unmarshal(data, new(WorkflowData))
+	require.EqualError(t, err, fmt.Sprintf("workflow data schema version %d is newer than the supported version %d",
+		WorkflowSchemaVersion+1, WorkflowSchemaVersion))
+}
+
+func TestWorkflowData_Upgrades(t *testing.T) {
+
+	// every version before the current one has an upgrade and a golden file
+	for version := 0; version <= WorkflowSchemaVersion; version++ {
+		if version < WorkflowSchemaVersion {
+			require.Contains(t, workflowUpgrades, version)
+		}
+		goldenWorkflowData(t, version)
+	}
+}
+
+func goldenWorkflowData(t *testing.T, version int) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", fmt.Sprintf("workflow_data_v%d.json", version)))
+	require.Nil(t, err)
+
+	return data
+}
@@ -0,0 +1,166 @@
+// Package cancel cancels buildkite jobs, stopping the codebuild job monitor execution and codebuild build which are
+// running the job
+package cancel
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wolfeidau/aws-launch/pkg/launcher/codebuild"
+	"github.com/wolfeidau/aws-launch/pkg/launcher/service"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/statemachine"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
+)
+
+// states of buildkite jobs which have been canceled
+const (
+	JobStateCanceling = "canceling"
+	JobStateCanceled  = "canceled"
+)
+
+// Canceller cancel buildkite jobs assigned to an agent
+type Canceller interface {
+	CancelJob(agentName string, agentConfig *api.Agent, job *api.Job) error
+}
+
+// JobCanceller cancel jobs, stopping the step function execution and codebuild build if the job is running
+type JobCanceller struct {
+	buildkiteAPI  bk.API
+	agentStore    store.AgentsAPI
+	workflowStore store.WorkflowStore
+	executor      statemachine.Executor
+	lch           codebuild.LauncherAPI
+}
+
+// NewJobCanceller create a new job canceller which stops executions using the executor
+func NewJobCanceller(cfg *config.Config, buildkiteAPI bk.API, executor statemachine.Executor) *JobCanceller {
+
+	config := aws.NewConfig()
+	lch := service.New(config).Codebuild
+
+	return &JobCanceller{
+		buildkiteAPI:  buildkiteAPI,
+		agentStore:    store.NewAgents(cfg),
+		workflowStore: store.NewWorkflows(cfg),
+		executor:      executor,
+		lch:           lch,
+	}
+}
+
+// CancelJob cancel a job assigned to the agent, if the job is running the execution is stopped along with the
+// codebuild build, then the job is finished with ExitStatusCanceled
+func (jc *JobCanceller) CancelJob(agentName string, agentConfig *api.Agent, job *api.Job) error {
+
+	evt := &bk.WorkflowData{Job: job, AgentName: agentName}
+
+	execution, err := jc.executor.FindByJobID(job.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to find execution")
+	}
+
+	if execution != nil && aws.StringValue(execution.Status) == sfn.ExecutionStatusRunning {
+
+		data, err := jc.executor.GetExecutionData(aws.StringValue(execution.ExecutionArn))
+		if err != nil {
+			return errors.Wrap(err, "failed to get execution data")
+		}
+
+		// stop the execution first so it doesn't also try to complete the job
+		err = jc.executor.StopExecution(aws.StringValue(execution.ExecutionArn), "job canceled")
+		if err != nil {
+			return errors.Wrap(err, "failed to stop execution")
+		}
+
+		err = json.Unmarshal(data, evt)
+		if err != nil {
+			return errors.Wrap(err, "failed to unmarshal execution data")
+		}
+	}
+
+	err = StopCanceledBuild(jc.lch, jc.buildkiteAPI, agentConfig, evt)
+	if err != nil {
+		return err
+	}
+
+	err = evt.UpdateJobExitCode()
+	if err != nil {
+		return errors.Wrap(err, "failed to update job exit code")
+	}
+
+	evt.Job.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+
+	err = jc.buildkiteAPI.FinishJob(agentConfig, evt.Job, "")
+	if err != nil && !bk.IsJobAlreadyFinished(err) {
+		return errors.Wrap(err, "failed to finish canceled job")
+	}
+
+	if execution != nil {
+		err = jc.agentStore.RemoveRunningJob(agentName, job.ID)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove running job")
+		}
+	}
+
+	// the stopped execution won't complete the job so the job it was passed by reference is deleted here
+	if evt.JobRef != "" {
+		err = jc.workflowStore.DeleteJob(evt.JobRef)
+		if err != nil {
+			return errors.Wrap(err, "failed to delete job from workflow store")
+		}
+	}
+
+	logrus.WithField("ID", job.ID).Info("job canceled")
+
+	return nil
+}
+
+// StopCanceledBuild stop the codebuild build, if there is one, for a job which was canceled in buildkite and explain
+// why in the job log, the job is flagged as cancelled so it is finished with ExitStatusCanceled
+func StopCanceledBuild(lch codebuild.LauncherAPI, buildkiteAPI bk.API, agentConfig *api.Agent, evt *bk.WorkflowData) error {
+
+	// already stopped on a previous check
+	if evt.Cancelled {
+		return nil
+	}
+
+	msg := "--- :no_entry_sign: Job canceled\n"
+
+	if evt.Codebuild != nil && evt.Codebuild.BuildID != "" && evt.Codebuild.BuildID != "NA:NA" {
+
+		stopRes, err := lch.StopTask(&codebuild.StopTaskParams{
+			ID: evt.Codebuild.BuildID,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to stop codebuild job")
+		}
+
+		logrus.WithFields(
+			logrus.Fields{
+				"projectName":     evt.Codebuild.ProjectName,
+				"id":              evt.Codebuild.BuildID,
+				"CodebuildStatus": stopRes.BuildStatus,
+			},
+		).Info("stopped canceled build")
+
+		evt.UpdateCodebuildStatus(evt.Codebuild.BuildID, stopRes.BuildStatus, stopRes.TaskStatus)
+
+		msg = fmt.Sprintf("--- :no_entry_sign: Job canceled, stopped codebuild build\nbuild_id=%s\n", evt.Codebuild.BuildID)
+	}
+
+	evt.Cancelled = true
+
+	err := evt.UploadMessage(buildkiteAPI, agentConfig, msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload cancel message")
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package cancel
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/aws-launch/mocks/codebuildmock"
+	"github.com/wolfeidau/aws-launch/pkg/launcher"
+	cblauncher "github.com/wolfeidau/aws-launch/pkg/launcher/codebuild"
+	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+func TestJobCanceller_CancelJob(t *testing.T) {
+
+	running, _ := json.Marshal(&bk.WorkflowData{
+		AgentName: "buildkite",
+		Job:       &api.Job{ID: "abc123"},
+		Codebuild: &bk.CodebuildWorkflowData{
+			BuildID: "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
+		},
+		LogSequence: 3,
+		LogBytes:    120,
+	})
+
+	// executions started with claim check jobs are passed a reference to the job
+	claimCheck, _ := json.Marshal(&bk.WorkflowData{
+		AgentName: "buildkite",
+		JobRef:    "abc123",
+		Codebuild: &bk.CodebuildWorkflowData{
+			BuildID: "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
+		},
+		LogSequence: 3,
+		LogBytes:    120,
+	})
+
+	tests := []struct {
+		name         string
+		execution    *sfn.ExecutionListItem
+		data         []byte
+		wantStopped  bool
+		wantRemoved  bool
+		wantDeleted  bool
+		wantSequence int
+	}{
+		{
+			name:         "cancel job which hasn't started",
+			wantStopped:  false,
+			wantSequence: 0,
+		},
+		{
+			name:         "cancel running job",
+			execution:    &sfn.ExecutionListItem{ExecutionArn: aws.String("test"), Status: aws.String(sfn.ExecutionStatusRunning)},
+			wantStopped:  true,
+			wantRemoved:  true,
+			wantSequence: 3,
+		},
+		{
+			name:         "cancel running job passed by reference",
+			execution:    &sfn.ExecutionListItem{ExecutionArn: aws.String("test"), Status: aws.String(sfn.ExecutionStatusRunning)},
+			data:         claimCheck,
+			wantStopped:  true,
+			wantRemoved:  true,
+			wantDeleted:  true,
+			wantSequence: 3,
+		},
+		{
+			name:         "cancel job with failed execution",
+			execution:    &sfn.ExecutionListItem{ExecutionArn: aws.String("test"), Status: aws.String(sfn.ExecutionStatusFailed)},
+			wantStopped:  false,
+			wantRemoved:  true,
+			wantSequence: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			agentStore := &mocks.AgentsAPI{}
+			agentStore.On("RemoveRunningJob", "buildkite", "abc123").Return(nil)
+
+			workflowStore := &mocks.WorkflowStore{}
+			workflowStore.On("DeleteJob", "abc123").Return(nil)
+
+			data := running
+			if tt.data != nil {
+				data = tt.data
+			}
+
+			executor := &mocks.Executor{}
+			executor.On("FindByJobID", "abc123").Return(tt.execution, nil)
+			executor.On("GetExecutionData", "test").Return(data, nil)
+			executor.On("StopExecution", "test", "job canceled").Return(nil)
+
+			lch := new(codebuildmock.LauncherAPI)
+			lch.On("StopTask", &cblauncher.StopTaskParams{ID: "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba"}).Return(
+				&cblauncher.StopTaskResult{
+					BuildStatus: codebuild.StatusTypeStopped,
+					TaskStatus:  launcher.TaskStopped,
+				}, nil,
+			)
+
+			buildkiteAPI := &mocks.API{}
+			buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.MatchedBy(func(chunk *api.Chunk) bool {
+				return chunk.Sequence == tt.wantSequence
+			})).Return(nil)
+			buildkiteAPI.On("FinishJob", mocks.AccessToken("token123"), mock.MatchedBy(func(job *api.Job) bool {
+				return job.ExitStatus == bk.ExitStatusCanceled && job.FinishedAt != ""
+			}), "").Return(nil)
+
+			jc := &JobCanceller{
+				buildkiteAPI:  buildkiteAPI,
+				agentStore:    agentStore,
+				workflowStore: workflowStore,
+				executor:      executor,
+				lch:           lch,
+			}
+
+			err := jc.CancelJob("buildkite", &api.Agent{AccessToken: "token123"}, &api.Job{ID: "abc123", State: "canceling"})
+			require.Nil(t, err)
+			buildkiteAPI.AssertExpectations(t)
+
+			if tt.wantStopped {
+				executor.AssertExpectations(t)
+				lch.AssertExpectations(t)
+			} else {
+				executor.AssertNotCalled(t, "StopExecution", mock.Anything, mock.Anything)
+				lch.AssertNotCalled(t, "StopTask", mock.Anything)
+			}
+
+			if tt.wantRemoved {
+				agentStore.AssertCalled(t, "RemoveRunningJob", "buildkite", "abc123")
+			} else {
+				agentStore.AssertNotCalled(t, "RemoveRunningJob", "buildkite", "abc123")
+			}
+
+			if tt.wantDeleted {
+				workflowStore.AssertCalled(t, "DeleteJob", "abc123")
+			} else {
+				workflowStore.AssertNotCalled(t, "DeleteJob", mock.Anything)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
-// DefaultBuildSpec default buildspec used in buildkite codebuild jobs
+// DefaultBuildSpec default buildspec used in buildkite codebuild jobs, the exit status of the bootstrap is written to
+// the artifact bucket so it can be reported to buildkite
 const DefaultBuildSpec = `
 version: 0.2
 
@@ -16,8 +17,9 @@ phases:
   build:
     commands:
       - echo Build started on $(date)
-      - /opt/buildkite/buildkite-agent bootstrap --build-path ${CODEBUILD_SRC_DIR} --bin-path /opt/buildkite
+      - /opt/buildkite/buildkite-agent bootstrap --build-path ${CODEBUILD_SRC_DIR} --bin-path /opt/buildkite; echo $? > /tmp/buildkite-exit-status; exit $(cat /tmp/buildkite-exit-status)
   post_build:
     commands:
       - echo Build completed on $(date)
+      - if [ -n "${EXIT_STATUS_KEY}" ] && [ -f /tmp/buildkite-exit-status ]; then aws s3 cp /tmp/buildkite-exit-status "s3://${ARTIFACT_BUCKET_NAME}/${EXIT_STATUS_KEY}"; fi
 `
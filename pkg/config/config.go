@@ -1,6 +1,9 @@
 package config
 
 import (
+	"net/url"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 )
@@ -11,17 +14,36 @@ var (
 
 	// ErrMissingEnvironmentNumber missing Environment number configuration
 	ErrMissingEnvironmentNumber = errors.New("Missing Environment Number ENV Variable")
+
+	// ErrInvalidHTTPProxy invalid http proxy configuration
+	ErrInvalidHTTPProxy = errors.New("Invalid HTTP Proxy ENV Variable")
 )
 
 // Config for the environment
 type Config struct {
-	LambdaHandler             string `envconfig:"LAMBDA_HANDLER"`
-	AwsRegion                 string `envconfig:"AWS_REGION"`
-	EnvironmentName           string `envconfig:"ENVIRONMENT_NAME"`
-	EnvironmentNumber         string `envconfig:"ENVIRONMENT_NUMBER"`
-	SfnCodebuildJobMonitorArn string `envconfig:"SFN_CODEBUILD_JOB_MONITOR_ARN"`
-	SfnAgentPollerArn         string `envconfig:"SFN_AGENT_POLLER_ARN"`
-	AgentTableName            string `envconfig:"AGENT_TABLE_NAME"`
+	LambdaHandler             string   `envconfig:"LAMBDA_HANDLER"`
+	AwsRegion                 string   `envconfig:"AWS_REGION"`
+	EnvironmentName           string   `envconfig:"ENVIRONMENT_NAME"`
+	EnvironmentNumber         string   `envconfig:"ENVIRONMENT_NUMBER"`
+	SfnCodebuildJobMonitorArn string   `envconfig:"SFN_CODEBUILD_JOB_MONITOR_ARN"`
+	SfnAgentPollerArn         string   `envconfig:"SFN_AGENT_POLLER_ARN"`
+	AgentTableName            string   `envconfig:"AGENT_TABLE_NAME"`
+	AgentTags                 []string `envconfig:"AGENT_TAGS"`
+	ArtifactBucketName        string   `envconfig:"ARTIFACT_BUCKET_NAME"` // artifacts written here by builds are registered with buildkite
+	ClaimCheckJobs            bool     `envconfig:"CLAIM_CHECK_JOBS"`     // pass executions a reference to the job saved in the workflow store
+
+	// buildkite agent api, agents use the endpoint returned by buildkite when they register
+	AgentEndpoint           string        `envconfig:"BUILDKITE_AGENT_ENDPOINT" default:"https://agent.buildkite.com/v3"`
+	HTTPTimeout             time.Duration `envconfig:"BUILDKITE_HTTP_TIMEOUT" default:"10s"`
+	HTTPDialTimeout         time.Duration `envconfig:"BUILDKITE_HTTP_DIAL_TIMEOUT" default:"30s"`
+	HTTPKeepAlive           time.Duration `envconfig:"BUILDKITE_HTTP_KEEP_ALIVE" default:"30s"`
+	HTTPIdleConnTimeout     time.Duration `envconfig:"BUILDKITE_HTTP_IDLE_CONN_TIMEOUT" default:"90s"`
+	HTTPMaxIdleConnsPerHost int           `envconfig:"BUILDKITE_HTTP_MAX_IDLE_CONNS_PER_HOST" default:"10"`
+	HTTPProxy               string        `envconfig:"BUILDKITE_HTTP_PROXY"` // defaults to the standard proxy environment variables
+	AgentTokenMaxAge        time.Duration `envconfig:"AGENT_TOKEN_MAX_AGE"`  // access tokens older than this are rotated, zero disables rotation
+
+	// local mode runs the agent poller and the codebuild job monitor in one process
+	LocalWaitTime time.Duration `envconfig:"LOCAL_WAIT_TIME"` // wait between job checks, defaults to the wait time of the job
 }
 
 // Validate checks the presence of the loaded template path on the filesystem
@@ -32,6 +54,11 @@ func (cfg *Config) Validate() error {
 	if cfg.EnvironmentNumber == "" {
 		return ErrMissingEnvironmentNumber
 	}
+	if cfg.HTTPProxy != "" {
+		if _, err := url.Parse(cfg.HTTPProxy); err != nil {
+			return ErrInvalidHTTPProxy
+		}
+	}
 
 	return nil
 }
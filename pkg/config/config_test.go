@@ -1,6 +1,8 @@
 package config
 
 import (
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,3 +43,11 @@ func TestConfig_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultBuildSpec(t *testing.T) {
+
+	// the buildspec used by the codebuild template should be kept in step with the default
+	data, err := ioutil.ReadFile("../../codebuild-template/buildspec.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimPrefix(DefaultBuildSpec, "\n"), string(data))
+}
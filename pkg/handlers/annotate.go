@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+)
+
+// getBuild load the codebuild build, returns nil if the build doesn't exist
+func getBuild(codebuildSvc codebuildiface.CodeBuildAPI, buildID string) (*codebuild.Build, error) {
+	res, err := codebuildSvc.BatchGetBuilds(&codebuild.BatchGetBuildsInput{
+		Ids: []*string{aws.String(buildID)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get codebuild build")
+	}
+
+	if len(res.Builds) == 0 {
+		return nil, nil
+	}
+
+	return res.Builds[0], nil
+}
+
+// failedPhase return the first phase of the build which didn't succeed
+func failedPhase(build *codebuild.Build) *codebuild.BuildPhase {
+	for _, phase := range build.Phases {
+		status := aws.StringValue(phase.PhaseStatus)
+		if status != "" && status != codebuild.StatusTypeSucceeded {
+			return phase
+		}
+	}
+
+	return nil
+}
+
+// infrastructureFailure return the failed phase of the build if it failed before or after running the buildkite
+// bootstrap in the BUILD phase, these failures aren't caused by the command run by the job
+func infrastructureFailure(build *codebuild.Build) *codebuild.BuildPhase {
+	phase := failedPhase(build)
+	if phase == nil || aws.StringValue(phase.PhaseType) == codebuild.BuildPhaseTypeBuild {
+		return nil
+	}
+
+	return phase
+}
+
+// phaseFailure describe why the phase failed using the status and messages of the phase
+func phaseFailure(phase *codebuild.BuildPhase) string {
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "%s phase %s", aws.StringValue(phase.PhaseType), aws.StringValue(phase.PhaseStatus))
+
+	for _, ctx := range phase.Contexts {
+		if msg := aws.StringValue(ctx.Message); msg != "" {
+			fmt.Fprintf(buf, ": %s", msg)
+		}
+	}
+
+	return buf.String()
+}
+
+// buildAnnotation summarise the codebuild build for the buildkite build, the context is unique to the job so
+// each job in the build has its own annotation
+func buildAnnotation(region, jobID string, build *codebuild.Build) *api.Annotation {
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "**:aws: CodeBuild** [%s](%s) %s", aws.StringValue(build.Id), buildURL(region, build), aws.StringValue(build.BuildStatus))
+
+	if build.StartTime != nil && build.EndTime != nil {
+		fmt.Fprintf(buf, " in %s", build.EndTime.Sub(*build.StartTime).Round(time.Second))
+	}
+
+	if build.Environment != nil {
+		fmt.Fprintf(buf, " on `%s`", aws.StringValue(build.Environment.ComputeType))
+	}
+
+	buf.WriteString("\n")
+
+	if phase := failedPhase(build); phase != nil {
+		fmt.Fprintf(buf, "\nFailed in the `%s` phase with status `%s`", aws.StringValue(phase.PhaseType), aws.StringValue(phase.PhaseStatus))
+
+		for _, ctx := range phase.Contexts {
+			if msg := aws.StringValue(ctx.Message); msg != "" {
+				fmt.Fprintf(buf, ": %s", msg)
+			}
+		}
+
+		buf.WriteString("\n")
+	}
+
+	return &api.Annotation{
+		Body:    buf.String(),
+		Context: fmt.Sprintf("codebuild-%s", jobID),
+		Style:   annotationStyle(aws.StringValue(build.BuildStatus)),
+	}
+}
+
+func annotationStyle(buildStatus string) string {
+	switch buildStatus {
+	case codebuild.StatusTypeSucceeded:
+		return "success"
+	case codebuild.StatusTypeStopped:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// buildURL link to the build in the codebuild console
+func buildURL(region string, build *codebuild.Build) string {
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/codesuite/codebuild/projects/%s/build/%s/log?region=%s",
+		region, url.PathEscape(aws.StringValue(build.ProjectName)), url.PathEscape(aws.StringValue(build.Id)), region)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildAnnotation(t *testing.T) {
+
+	started := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		build *codebuild.Build
+		want  *api.Annotation
+	}{
+		{
+			name: "buildAnnotation() with succeeded build",
+			build: &codebuild.Build{
+				Id:          aws.String("buildkite-dev-1:58df10ab"),
+				ProjectName: aws.String("buildkite-dev-1"),
+				BuildStatus: aws.String(codebuild.StatusTypeSucceeded),
+				StartTime:   aws.Time(started),
+				EndTime:     aws.Time(started.Add(125 * time.Second)),
+				Environment: &codebuild.ProjectEnvironment{ComputeType: aws.String(codebuild.ComputeTypeBuildGeneral1Small)},
+				Phases: []*codebuild.BuildPhase{
+					&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeBuild), PhaseStatus: aws.String(codebuild.StatusTypeSucceeded)},
+					&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeCompleted)},
+				},
+			},
+			want: &api.Annotation{
+				Body:    "**:aws: CodeBuild** [buildkite-dev-1:58df10ab](https://us-east-1.console.aws.amazon.com/codesuite/codebuild/projects/buildkite-dev-1/build/buildkite-dev-1:58df10ab/log?region=us-east-1) SUCCEEDED in 2m5s on `BUILD_GENERAL1_SMALL`\n",
+				Context: "codebuild-abc123",
+				Style:   "success",
+			},
+		},
+		{
+			name: "buildAnnotation() with failed phase",
+			build: &codebuild.Build{
+				Id:          aws.String("buildkite-dev-1:58df10ab"),
+				ProjectName: aws.String("buildkite-dev-1"),
+				BuildStatus: aws.String(codebuild.StatusTypeFailed),
+				Phases: []*codebuild.BuildPhase{
+					&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeInstall), PhaseStatus: aws.String(codebuild.StatusTypeSucceeded)},
+					&codebuild.BuildPhase{
+						PhaseType:   aws.String(codebuild.BuildPhaseTypePreBuild),
+						PhaseStatus: aws.String(codebuild.StatusTypeFailed),
+						Contexts:    []*codebuild.PhaseContext{&codebuild.PhaseContext{Message: aws.String("Error while executing command: chmod 600 ~/.ssh/id_rsa")}},
+					},
+				},
+			},
+			want: &api.Annotation{
+				Body:    "**:aws: CodeBuild** [buildkite-dev-1:58df10ab](https://us-east-1.console.aws.amazon.com/codesuite/codebuild/projects/buildkite-dev-1/build/buildkite-dev-1:58df10ab/log?region=us-east-1) FAILED\n\nFailed in the `PRE_BUILD` phase with status `FAILED`: Error while executing command: chmod 600 ~/.ssh/id_rsa\n",
+				Context: "codebuild-abc123",
+				Style:   "error",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildAnnotation("us-east-1", "abc123", tt.build)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+const (
+	artifactStateFinished = "finished"
+
+	// artifacts are created in batches of this size, as the buildkite agent does
+	artifactBatchSize = 30
+
+	// user metadata holding the sha1 of the artifact, this is set by the build when it uploads the artifact
+	artifactSha1Metadata = "sha1"
+
+	// artifacts without the sha1 metadata are only hashed if they are smaller than this, so reading them can't time
+	// out the lambda
+	maxHashedArtifactSize = 5 * 1024 * 1024
+)
+
+// registerArtifacts register the artifacts written by the build under the artifact prefix of the job with buildkite,
+// the artifacts stay in the bucket and keep the path relative to the prefix, returns the number of artifacts. The
+// batches are identified using the job so registering the artifacts again, when the step is retried, doesn't create
+// duplicates.
+func registerArtifacts(s3Svc s3iface.S3API, buildkiteAPI bk.API, agentConfig *api.Agent, bucket string, evt *bk.WorkflowData) (int, error) {
+
+	prefix := bk.ArtifactPrefix(evt.Job.ID)
+	destination := fmt.Sprintf("s3://%s/%s", bucket, strings.TrimSuffix(prefix, "/"))
+
+	objects, err := listArtifacts(s3Svc, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	artifacts := []*api.Artifact{}
+
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		path := strings.TrimPrefix(key, prefix)
+
+		sha1sum, err := artifactSha1Sum(s3Svc, bucket, obj)
+		if err != nil {
+			return 0, err
+		}
+
+		if sha1sum == "" {
+			logrus.WithField("ID", evt.Job.ID).WithField("key", key).Warn("skipping large artifact without sha1 metadata")
+			continue
+		}
+
+		// the path the artifact was written to in the build isn't known so the absolute path is left empty
+		artifacts = append(artifacts, &api.Artifact{
+			Path:              path,
+			GlobPath:          path,
+			FileSize:          aws.Int64Value(obj.Size),
+			Sha1Sum:           sha1sum,
+			URL:               artifactURL(bucket, key),
+			UploadDestination: destination,
+		})
+	}
+
+	for start := 0; start < len(artifacts); start += artifactBatchSize {
+		end := start + artifactBatchSize
+		if end > len(artifacts) {
+			end = len(artifacts)
+		}
+
+		err := createArtifacts(buildkiteAPI, agentConfig, evt.Job.ID, &api.ArtifactBatch{
+			ID:                artifactBatchID(evt.Job.ID, start/artifactBatchSize),
+			Artifacts:         artifacts[start:end],
+			UploadDestination: destination,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(artifacts), nil
+}
+
+// artifactURL the url of the artifact in the bucket, each segment of the key is escaped so keys containing spaces
+// or reserved characters such as # and ? can be downloaded
+func artifactURL(bucket, key string) string {
+
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, strings.Join(segments, "/"))
+}
+
+func createArtifacts(buildkiteAPI bk.API, agentConfig *api.Agent, jobID string, batch *api.ArtifactBatch) error {
+
+	res, err := buildkiteAPI.CreateArtifacts(agentConfig, jobID, batch)
+	if err != nil {
+		return errors.Wrap(err, "failed to create artifacts")
+	}
+
+	// the artifacts are already in the bucket so they are all finished
+	states := make(map[string]string, len(res.ArtifactIDs))
+	for _, id := range res.ArtifactIDs {
+		states[id] = artifactStateFinished
+	}
+
+	err = buildkiteAPI.UpdateArtifacts(agentConfig, jobID, states)
+	if err != nil {
+		return errors.Wrap(err, "failed to update artifacts")
+	}
+
+	return nil
+}
+
+// artifactBatchID a uuid which is the same each time the batch of artifacts for the job is created
+func artifactBatchID(jobID string, batch int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/artifacts/%d", jobID, batch)))
+
+	// mark the uuid as name based using sha1, version 5
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func listArtifacts(s3Svc s3iface.S3API, bucket, prefix string) ([]*s3.Object, error) {
+
+	var objects []*s3.Object
+
+	err := s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			// skip folder placeholders
+			if strings.HasSuffix(aws.StringValue(obj.Key), "/") {
+				continue
+			}
+			objects = append(objects, obj)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list artifacts")
+	}
+
+	return objects, nil
+}
+
+// artifactSha1Sum buildkite requires the sha1 of each artifact which isn't stored by s3, builds store it in the
+// metadata of the object otherwise small objects are read, returns an empty string if the sha1 isn't known
+func artifactSha1Sum(s3Svc s3iface.S3API, bucket string, obj *s3.Object) (string, error) {
+
+	key := aws.StringValue(obj.Key)
+
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get artifact metadata %s", key)
+	}
+
+	for name, value := range head.Metadata {
+		if strings.EqualFold(name, artifactSha1Metadata) && aws.StringValue(value) != "" {
+			return strings.ToLower(aws.StringValue(value)), nil
+		}
+	}
+
+	if aws.Int64Value(obj.Size) > maxHashedArtifactSize {
+		return "", nil
+	}
+
+	res, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get artifact %s", key)
+	}
+	defer res.Body.Close()
+
+	hash := sha1.New()
+
+	_, err = io.Copy(hash, res.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read artifact %s", key)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// fakeS3 serves objects from memory, only the operations used to register artifacts and read exit statuses are implemented
+type fakeS3 struct {
+	s3iface.S3API
+	objects  map[string]string
+	metadata map[string]map[string]*string
+	sizes    map[string]int64
+	gets     []string
+}
+
+func (fs *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	keys := []string{}
+	for key := range fs.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		size, ok := fs.sizes[key]
+		if !ok {
+			size = int64(len(fs.objects[key]))
+		}
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(size)})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (fs *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if _, ok := fs.objects[aws.StringValue(input.Key)]; !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{Metadata: fs.metadata[aws.StringValue(input.Key)]}, nil
+}
+
+func (fs *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	fs.gets = append(fs.gets, aws.StringValue(input.Key))
+	data, ok := fs.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewBufferString(data))}, nil
+}
+
+func Test_registerArtifacts(t *testing.T) {
+
+	s3Svc := &fakeS3{
+		objects: map[string]string{
+			"artifacts/abc123/":              "",
+			"artifacts/abc123/coverage.html": "<html></html>",
+			"artifacts/abc123/dist/app.zip":  "zip",
+			"artifacts/abc123/dist/big.iso":  "iso",
+			"exit-status/abc123":             "0",
+		},
+		metadata: map[string]map[string]*string{
+			"artifacts/abc123/coverage.html": {"Sha1": aws.String("4A0B0B6C0E4F6D5AD4A8B6E8F0D4D0A6C1E2F3A4")},
+		},
+		sizes: map[string]int64{"artifacts/abc123/dist/big.iso": maxHashedArtifactSize + 1},
+	}
+
+	buildkiteAPI := &mocks.API{}
+	buildkiteAPI.On("CreateArtifacts", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.ArtifactBatch")).Return(&api.ArtifactBatchCreateResponse{
+		ArtifactIDs: []string{"art1", "art2"},
+	}, nil)
+	buildkiteAPI.On("UpdateArtifacts", mocks.AccessToken("token123"), "abc123", map[string]string{"art1": "finished", "art2": "finished"}).Return(nil)
+
+	evt := &bk.WorkflowData{Job: &api.Job{ID: "abc123"}}
+
+	count, err := registerArtifacts(s3Svc, buildkiteAPI, &api.Agent{AccessToken: "token123"}, "artifact-bucket", evt)
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	buildkiteAPI.AssertExpectations(t)
+
+	// only the small artifact without the sha1 metadata is read
+	require.Equal(t, []string{"artifacts/abc123/dist/app.zip"}, s3Svc.gets)
+
+	batch := buildkiteAPI.Calls[0].Arguments.Get(2).(*api.ArtifactBatch)
+	require.Equal(t, artifactBatchID("abc123", 0), batch.ID)
+	require.Equal(t, "s3://artifact-bucket/artifacts/abc123", batch.UploadDestination)
+	require.Len(t, batch.Artifacts, 2)
+	require.Equal(t, "4a0b0b6c0e4f6d5ad4a8b6e8f0d4d0a6c1e2f3a4", batch.Artifacts[0].Sha1Sum)
+	require.Equal(t, &api.Artifact{
+		Path:              "dist/app.zip",
+		GlobPath:          "dist/app.zip",
+		FileSize:          3,
+		Sha1Sum:           "f13e27693c85aed522df8c3fcb0bb0110ca54e14",
+		URL:               "https://artifact-bucket.s3.amazonaws.com/artifacts/abc123/dist/app.zip",
+		UploadDestination: "s3://artifact-bucket/artifacts/abc123",
+	}, batch.Artifacts[1])
+}
+
+func Test_registerArtifacts_NoArtifacts(t *testing.T) {
+
+	buildkiteAPI := &mocks.API{}
+
+	evt := &bk.WorkflowData{Job: &api.Job{ID: "abc123"}}
+
+	count, err := registerArtifacts(&fakeS3{}, buildkiteAPI, &api.Agent{AccessToken: "token123"}, "artifact-bucket", evt)
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	buildkiteAPI.AssertNotCalled(t, "CreateArtifacts", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_registerArtifacts_Batches(t *testing.T) {
+
+	s3Svc := &fakeS3{objects: map[string]string{}, metadata: map[string]map[string]*string{}}
+	for i := 0; i < 65; i++ {
+		key := fmt.Sprintf("artifacts/abc123/file%02d.txt", i)
+		s3Svc.objects[key] = "data"
+		s3Svc.metadata[key] = map[string]*string{"Sha1": aws.String("a17c9aaa61e80a1bf71d0d850af4e5baa9800bbd")}
+	}
+
+	buildkiteAPI := &mocks.API{}
+	buildkiteAPI.On("CreateArtifacts", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.ArtifactBatch")).Return(&api.ArtifactBatchCreateResponse{
+		ArtifactIDs: []string{"art1"},
+	}, nil)
+	buildkiteAPI.On("UpdateArtifacts", mocks.AccessToken("token123"), "abc123", map[string]string{"art1": "finished"}).Return(nil)
+
+	evt := &bk.WorkflowData{Job: &api.Job{ID: "abc123"}}
+
+	count, err := registerArtifacts(s3Svc, buildkiteAPI, &api.Agent{AccessToken: "token123"}, "artifact-bucket", evt)
+	require.Nil(t, err)
+	require.Equal(t, 65, count)
+	require.Empty(t, s3Svc.gets)
+
+	batches := []*api.ArtifactBatch{}
+	for _, call := range buildkiteAPI.Calls {
+		if call.Method == "CreateArtifacts" {
+			batches = append(batches, call.Arguments.Get(2).(*api.ArtifactBatch))
+		}
+	}
+
+	require.Len(t, batches, 3)
+	require.Len(t, batches[0].Artifacts, 30)
+	require.Len(t, batches[1].Artifacts, 30)
+	require.Len(t, batches[2].Artifacts, 5)
+	require.Equal(t, "file60.txt", batches[2].Artifacts[0].Path)
+}
+
+func Test_artifactURL(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{
+			name: "artifactURL() with key which doesn't need escaping",
+			key:  "artifacts/abc123/dist/app.zip",
+			want: "https://artifact-bucket.s3.amazonaws.com/artifacts/abc123/dist/app.zip",
+		},
+		{
+			name: "artifactURL() with key which needs escaping",
+			key:  "artifacts/abc123/test reports/results #1?.xml",
+			want: "https://artifact-bucket.s3.amazonaws.com/artifacts/abc123/test%20reports/results%20%231%3F.xml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, artifactURL("artifact-bucket", tt.key))
+		})
+	}
+}
+
+func Test_artifactBatchID(t *testing.T) {
+
+	id := artifactBatchID("abc123", 0)
+
+	// registering the same batch again uses the same id
+	require.Equal(t, id, artifactBatchID("abc123", 0))
+	require.NotEqual(t, id, artifactBatchID("abc123", 1))
+	require.NotEqual(t, id, artifactBatchID("def456", 0))
+
+	require.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", id)
+}
@@ -2,15 +2,18 @@ package handlers
 
 import (
 	"context"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/aws-launch/pkg/cwlogs"
+	"github.com/wolfeidau/aws-launch/pkg/launcher"
 	"github.com/wolfeidau/aws-launch/pkg/launcher/codebuild"
 	"github.com/wolfeidau/aws-launch/pkg/launcher/service"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/cancel"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
@@ -63,12 +66,15 @@ func (ch *CheckJobHandler) HandlerCheckJob(ctx context.Context, evt *bk.Workflow
 		return nil, errors.Wrap(err, "failed to load agent from store")
 	}
 
-	err = uploadLogChunks(agent.AgentConfig.AccessToken, ch.buildkiteAPI, ch.logsReader, evt)
+	// jobs accepted before the access token was rotated use the previous agent config
+	agentConfig := agent.AgentConfigFor(evt.AgentTokenID)
+
+	err = uploadLogChunks(agentConfig, ch.buildkiteAPI, ch.logsReader, evt)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to upload log chunks")
 	}
 
-	jobStatus, err := ch.buildkiteAPI.GetStateJob(agent.AgentConfig.AccessToken, evt.Job.ID)
+	jobStatus, err := ch.buildkiteAPI.GetStateJob(agentConfig, evt.Job.ID)
 	if err != nil {
 		return nil, errors.Wrap(err, "call to the buildkite api failed")
 	}
@@ -83,26 +89,19 @@ func (ch *CheckJobHandler) HandlerCheckJob(ctx context.Context, evt *bk.Workflow
 		},
 	).Info("checked build")
 
-	// if job status is canceled then we need to stop codebuild and mark the job as complete
-	switch jobStatus.State {
-	case "canceled":
-		stopRes, err := ch.lch.StopTask(&codebuild.StopTaskParams{
-			ID: getStatus.ID,
-		})
+	// if job status is canceled then we need to stop codebuild, the job is finished with a canceled exit status
+	// once the build has stopped, the same applies to jobs which exceed their timeout
+	switch {
+	case jobStatus.State == cancel.JobStateCanceling || jobStatus.State == cancel.JobStateCanceled:
+		err := cancel.StopCanceledBuild(ch.lch, ch.buildkiteAPI, agentConfig, evt)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to stop codebuild job")
+			return nil, errors.Wrap(err, "failed to stop canceled build")
+		}
+	case evt.TaskStatus == launcher.TaskRunning && evt.JobTimedOut(time.Now()):
+		err := stopTimedOutBuild(ch.lch, ch.buildkiteAPI, agentConfig, evt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to stop timed out build")
 		}
-
-		logrus.WithFields(
-			logrus.Fields{
-				"projectName":     evt.Codebuild.ProjectName,
-				"id":              evt.Codebuild.BuildID,
-				"CodebuildStatus": stopRes.BuildStatus,
-				"buildkiteStatus": jobStatus.State,
-			},
-		).Info("stopped canceled build")
-
-		evt.UpdateCodebuildStatus(getStatus.ID, stopRes.BuildStatus, stopRes.TaskStatus)
 	}
 
 	return evt, nil
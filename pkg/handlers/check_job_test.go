@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
@@ -25,9 +27,13 @@ func TestCheckJobHandler_HandlerCheckJob_Running(t *testing.T) {
 
 	agentStore := &mocks.AgentsAPI{}
 
+	// the job was accepted before the access token was rotated
 	agentStore.On("Get", "buildkite").Return(&store.AgentRecord{
 		Name: "buildkite",
 		AgentConfig: &api.Agent{
+			AccessToken: "token456",
+		},
+		PreviousAgentConfig: &api.Agent{
 			AccessToken: "token123",
 		},
 	}, nil)
@@ -45,7 +51,7 @@ func TestCheckJobHandler_HandlerCheckJob_Running(t *testing.T) {
 	)
 
 	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("GetStateJob", "token123", "abc123").Return(&api.JobState{
+	buildkiteAPI.On("GetStateJob", mocks.AccessToken("token123"), "abc123").Return(&api.JobState{
 		State: "running",
 	}, nil)
 
@@ -55,7 +61,8 @@ func TestCheckJobHandler_HandlerCheckJob_Running(t *testing.T) {
 	}
 
 	evt := &bk.WorkflowData{
-		AgentName: "buildkite",
+		AgentName:    "buildkite",
+		AgentTokenID: store.TokenID("token123"),
 		Codebuild: &bk.CodebuildWorkflowData{
 			BuildID:       "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
 			ProjectName:   "whatever",
@@ -121,9 +128,10 @@ func TestCheckJobHandler_HandlerCheckJob_Cancelled(t *testing.T) {
 	)
 
 	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("GetStateJob", "token123", "abc123").Return(&api.JobState{
+	buildkiteAPI.On("GetStateJob", mocks.AccessToken("token123"), "abc123").Return(&api.JobState{
 		State: "canceled",
 	}, nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
 
 	cfg := &config.Config{
 		EnvironmentName:   "dev",
@@ -163,4 +171,89 @@ func TestCheckJobHandler_HandlerCheckJob_Cancelled(t *testing.T) {
 	got, err := ch.HandlerCheckJob(context.TODO(), evt)
 	require.Nil(t, err)
 	require.Equal(t, codebuild.StatusTypeStopped, got.Codebuild.BuildStatus)
+	require.True(t, got.Cancelled)
+	require.Equal(t, 1, got.LogSequence)
+	lch.AssertNumberOfCalls(t, "StopTask", 1)
+
+	// the build is only stopped once
+	got, err = ch.HandlerCheckJob(context.TODO(), got)
+	require.Nil(t, err)
+	lch.AssertNumberOfCalls(t, "StopTask", 1)
+}
+
+func TestCheckJobHandler_HandlerCheckJob_TimedOut(t *testing.T) {
+
+	agentStore := &mocks.AgentsAPI{}
+
+	agentStore.On("Get", "buildkite").Return(&store.AgentRecord{
+		Name: "buildkite",
+		AgentConfig: &api.Agent{
+			AccessToken: "token123",
+		},
+	}, nil)
+
+	lch := new(codebuildmock.LauncherAPI)
+	lch.On("GetTaskStatus", mock.AnythingOfType("*codebuild.GetTaskStatusParams")).Return(
+		&cblauncher.GetTaskStatusResult{
+			ID:          "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
+			TaskStatus:  launcher.TaskRunning,
+			BuildStatus: codebuild.StatusTypeInProgress,
+		}, nil,
+	)
+	lch.On("StopTask", mock.AnythingOfType("*codebuild.StopTaskParams")).Return(
+		&cblauncher.StopTaskResult{
+			BuildStatus: codebuild.StatusTypeStopped,
+			TaskStatus:  launcher.TaskStopped,
+		}, nil,
+	)
+
+	buildkiteAPI := &mocks.API{}
+	buildkiteAPI.On("GetStateJob", mocks.AccessToken("token123"), "abc123").Return(&api.JobState{
+		State: "running",
+	}, nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.MatchedBy(func(chunk *api.Chunk) bool {
+		return strings.HasPrefix(chunk.Data, "--- :alarm_clock: Job timed out after 10 minutes")
+	})).Return(nil)
+
+	cfg := &config.Config{
+		EnvironmentName:   "dev",
+		EnvironmentNumber: "1",
+	}
+
+	evt := &bk.WorkflowData{
+		AgentName: "buildkite",
+		Codebuild: &bk.CodebuildWorkflowData{
+			ProjectName:   "whatever",
+			BuildStatus:   codebuild.StatusTypeInProgress,
+			BuildID:       "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
+			LogGroupName:  "/aws/codebuild/buildkite-dev-1",
+			LogStreamName: "58df10ab-9dc5-4c7f-b0c3-6a02b63306ba",
+		},
+		Job: &api.Job{
+			ID:                 "abc123",
+			ChunksMaxSizeBytes: 102400,
+			Env:                map[string]string{"BUILDKITE_TIMEOUT": "10"},
+			StartedAt:          time.Now().Add(-15 * time.Minute).UTC().Format(time.RFC3339Nano),
+		},
+		NextToken: "nextToken",
+	}
+
+	logsReader := &launchmocks.LogsReader{}
+	logsReader.On("ReadLogs", mock.AnythingOfType("*cwlogs.ReadLogsParams")).Return(&cwlogs.ReadLogsResult{}, nil)
+
+	ch := &CheckJobHandler{
+		cfg:          cfg,
+		agentStore:   agentStore,
+		buildkiteAPI: buildkiteAPI,
+		lch:          lch,
+		logsReader:   logsReader,
+	}
+	got, err := ch.HandlerCheckJob(context.TODO(), evt)
+	require.Nil(t, err)
+	require.Equal(t, codebuild.StatusTypeStopped, got.Codebuild.BuildStatus)
+	require.True(t, got.TimedOut)
+	require.False(t, got.Cancelled)
+	require.Equal(t, 1, got.LogSequence)
+	lch.AssertNumberOfCalls(t, "StopTask", 1)
+	buildkiteAPI.AssertExpectations(t)
 }
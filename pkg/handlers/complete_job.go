@@ -2,8 +2,14 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/aws-launch/pkg/cwlogs"
@@ -19,6 +25,8 @@ type CompletedJobHandler struct {
 	agentStore   store.AgentsAPI
 	buildkiteAPI bk.API
 	logsReader   cwlogs.LogsReader
+	codebuildSvc codebuildiface.CodeBuildAPI
+	s3Svc        s3iface.S3API
 }
 
 // NewCompletedJobHandler create a new handler
@@ -32,6 +40,8 @@ func NewCompletedJobHandler(cfg *config.Config, sess *session.Session, buildkite
 		agentStore:   store.NewAgents(cfg),
 		buildkiteAPI: buildkiteAPI,
 		logsReader:   logsReader,
+		codebuildSvc: codebuild.New(sess),
+		s3Svc:        s3.New(sess),
 	}
 }
 
@@ -43,22 +53,121 @@ func (bkw *CompletedJobHandler) HandlerCompletedJob(ctx context.Context, evt *bk
 		return nil, errors.Wrap(err, "failed to load agent from store")
 	}
 
+	// jobs accepted before the access token was rotated use the previous agent config
+	agentConfig := agent.AgentConfigFor(evt.AgentTokenID)
+
 	err = evt.UpdateJobExitCode()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to update job exit code")
 	}
 
-	err = bkw.buildkiteAPI.FinishJob(agent.AgentConfig.AccessToken, evt.Job)
+	// the exit status of the command run by the build replaces the one derived from the codebuild status, so
+	// buildkite can act on it, for example to retry the job
+	if bkw.cfg.ArtifactBucketName != "" && !evt.Cancelled && !evt.TimedOut && !evt.BuildTimedOut() {
+		exitStatus, err := commandExitStatus(bkw.s3Svc, bkw.cfg.ArtifactBucketName, evt)
+		if err != nil {
+			logrus.WithError(err).WithField("ID", evt.Job.ID).Warn("failed to read command exit status")
+		} else if exitStatus != "" {
+			evt.Job.ExitStatus = exitStatus
+		}
+	}
+
+	// the build is only used to explain the outcome of the job so failing to load it doesn't fail the job
+	build, err := bkw.getBuild(evt)
 	if err != nil {
+		logrus.WithError(err).WithField("ID", evt.Job.ID).Warn("failed to load build")
+	}
+
+	// the annotation is informational so it doesn't fail the job
+	if build != nil {
+		err = bkw.buildkiteAPI.CreateAnnotation(agentConfig, evt.Job.ID, buildAnnotation(bkw.cfg.AwsRegion, evt.Job.ID, build))
+		if err != nil {
+			logrus.WithError(err).WithField("ID", evt.Job.ID).Warn("failed to annotate build")
+		}
+	}
+
+	// builds which failed outside of the command run by the job are finished with the process run error signal
+	// reason, this separates infrastructure failures, such as fetching the ssh key, from failing tests
+	var failure *codebuild.BuildPhase
+	if build != nil && !evt.Cancelled && !evt.TimedOut && !evt.BuildTimedOut() {
+		failure = infrastructureFailure(build)
+	}
+
+	// jobs are also completed after a task of the state machine failed, the command may not have run
+	signalReason := ""
+	if failure != nil || evt.TaskError != nil {
+		signalReason = bk.SignalReasonProcessRunError
+	}
+
+	err = bkw.buildkiteAPI.FinishJob(agentConfig, evt.Job, signalReason)
+	if err != nil && !bk.IsJobAlreadyFinished(err) {
 		return nil, errors.Wrap(err, "failed to finish job")
 	}
 
 	logrus.WithField("ID", evt.Job.ID).Info("job completed!")
 
-	err = uploadLogChunks(agent.AgentConfig.AccessToken, bkw.buildkiteAPI, bkw.logsReader, evt)
+	// the agent can accept another job once this one is removed from the running job index
+	err = bkw.agentStore.RemoveRunningJob(evt.AgentName, evt.Job.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to remove running job")
+	}
+
+	// artifacts written to the artifact bucket by the build are registered once the job is finished, so registering
+	// them can't stop the job finishing, the batches are the same if the step is retried
+	if bkw.cfg.ArtifactBucketName != "" {
+		count, err := registerArtifacts(bkw.s3Svc, bkw.buildkiteAPI, agentConfig, bkw.cfg.ArtifactBucketName, evt)
+		if err != nil {
+			logrus.WithError(err).WithField("ID", evt.Job.ID).Warn("failed to register artifacts")
+		} else {
+			logrus.WithField("ID", evt.Job.ID).WithField("count", count).Info("registered artifacts")
+		}
+	}
+
+	err = uploadLogChunks(agentConfig, bkw.buildkiteAPI, bkw.logsReader, evt)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to upload log chunks")
 	}
 
+	// the failure is explained at the end of the job log after the output of the build
+	if failure != nil {
+		msg := fmt.Sprintf("--- :rotating_light: CodeBuild build failed in the %s phase\n%s\n",
+			aws.StringValue(failure.PhaseType), phaseFailure(failure))
+
+		err = evt.UploadMessage(bkw.buildkiteAPI, agentConfig, msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload failed phase message")
+		}
+	}
+
+	if evt.TaskError != nil {
+		msg := fmt.Sprintf("--- :rotating_light: Job monitor failed with %s\n%s\n", evt.TaskError.Error, evt.TaskError.Cause)
+
+		err = evt.UploadMessage(bkw.buildkiteAPI, agentConfig, msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload job monitor failure message")
+		}
+	}
+
+	// builds stopped by codebuild are explained in the same way as jobs stopped by the check job handler
+	if evt.BuildTimedOut() && !evt.TimedOut {
+		msg := fmt.Sprintf("--- :alarm_clock: Job timed out, codebuild stopped the build after the build timeout\nbuild_id=%s\n",
+			evt.Codebuild.BuildID)
+
+		err = evt.UploadMessage(bkw.buildkiteAPI, agentConfig, msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload timed out message")
+		}
+	}
+
 	return evt, nil
 }
+
+// getBuild load the codebuild build for the job, returns nil if the build was never started
+func (bkw *CompletedJobHandler) getBuild(evt *bk.WorkflowData) (*codebuild.Build, error) {
+
+	if evt.Codebuild == nil || evt.Codebuild.BuildID == "" {
+		return nil, nil // the build was never started
+	}
+
+	return getBuild(bkw.codebuildSvc, evt.Codebuild.BuildID)
+}
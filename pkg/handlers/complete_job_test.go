@@ -2,12 +2,14 @@ package handlers
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	launchmocks "github.com/wolfeidau/aws-launch/mocks"
@@ -28,14 +30,13 @@ func TestCompletedJobHandler_HandlerCompletedJob(t *testing.T) {
 			AccessToken: "token123",
 		},
 	}, nil)
+	agentStore.On("RemoveRunningJob", "buildkite", mock.AnythingOfType("string")).Return(nil)
 
 	cwlogsSvc := &mocks.CloudWatchLogsAPI{}
 	cwlogsSvc.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(&cloudwatchlogs.GetLogEventsOutput{}, nil)
 
-	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("FinishJob", "token123", mock.AnythingOfType("*api.Job")).Return(nil)
-
 	cfg := &config.Config{
+		AwsRegion:         "us-east-1",
 		EnvironmentName:   "dev",
 		EnvironmentNumber: "1",
 	}
@@ -53,10 +54,15 @@ func TestCompletedJobHandler_HandlerCompletedJob(t *testing.T) {
 		status string
 	}
 	tests := []struct {
-		name    string
-		args    args
-		want    string
-		wantErr bool
+		name             string
+		args             args
+		finishErr        error
+		exitStatus       string // written to the artifact bucket by the build
+		phases           []*codebuild.BuildPhase
+		want             string
+		wantSignalReason string
+		wantMessage      string // uploaded to the job log after the build output
+		wantErr          bool
 	}{
 		{
 			name: "completed build with StatusTypeSucceeded",
@@ -88,24 +94,156 @@ func TestCompletedJobHandler_HandlerCompletedJob(t *testing.T) {
 			want:    "-3",
 			wantErr: false,
 		},
+		{
+			name: "completed build with command exit status",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeFailed,
+			},
+			exitStatus: "3\n",
+			want:       "3",
+			wantErr:    false,
+		},
+		{
+			name: "completed build which failed in the PRE_BUILD phase",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeFailed,
+			},
+			phases: []*codebuild.BuildPhase{
+				&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeInstall), PhaseStatus: aws.String(codebuild.StatusTypeSucceeded)},
+				&codebuild.BuildPhase{
+					PhaseType:   aws.String(codebuild.BuildPhaseTypePreBuild),
+					PhaseStatus: aws.String(codebuild.StatusTypeFailed),
+					Contexts:    []*codebuild.PhaseContext{&codebuild.PhaseContext{Message: aws.String("Error while executing command: chmod 600 ~/.ssh/id_rsa")}},
+				},
+			},
+			want:             "-2",
+			wantSignalReason: bk.SignalReasonProcessRunError,
+			wantMessage:      "PRE_BUILD phase FAILED: Error while executing command: chmod 600 ~/.ssh/id_rsa",
+			wantErr:          false,
+		},
+		{
+			name: "completed build which failed in the BUILD phase",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeFailed,
+			},
+			phases: []*codebuild.BuildPhase{
+				&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypePreBuild), PhaseStatus: aws.String(codebuild.StatusTypeSucceeded)},
+				&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeBuild), PhaseStatus: aws.String(codebuild.StatusTypeFailed)},
+			},
+			want:    "-2",
+			wantErr: false,
+		},
+		{
+			name: "completed build which timed out",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeTimedOut,
+			},
+			phases: []*codebuild.BuildPhase{
+				&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypePreBuild), PhaseStatus: aws.String(codebuild.StatusTypeSucceeded)},
+				&codebuild.BuildPhase{PhaseType: aws.String(codebuild.BuildPhaseTypeBuild), PhaseStatus: aws.String(codebuild.StatusTypeTimedOut)},
+			},
+			want:        bk.ExitStatusTimedOut,
+			wantMessage: "codebuild stopped the build after the build timeout",
+			wantErr:     false,
+		},
+		{
+			name: "completed build after the job monitor failed",
+			args: args{
+				ctx: context.TODO(),
+				evt: func() *bk.WorkflowData {
+					evt := newEvent()
+					evt.TaskError = &bk.TaskError{Error: "UnauthorizedError", Cause: "failed to get task status: unauthorized"}
+					return evt
+				}(),
+				status: codebuild.StatusTypeInProgress,
+			},
+			want:             bk.ExitStatusUnknown,
+			wantSignalReason: bk.SignalReasonProcessRunError,
+			wantMessage:      "Job monitor failed with UnauthorizedError\nfailed to get task status: unauthorized",
+			wantErr:          false,
+		},
+		{
+			name: "completed build which was already finished",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeSucceeded,
+			},
+			finishErr: errors.Wrap(&bk.JobAlreadyFinishedError{APIError: &bk.APIError{StatusCode: 422}}, "failed to finish job"),
+			want:      "0",
+			wantErr:   false,
+		},
+		{
+			name: "completed build with revoked access token",
+			args: args{
+				ctx:    context.TODO(),
+				evt:    newEvent(),
+				status: codebuild.StatusTypeSucceeded,
+			},
+			finishErr: errors.Wrap(&bk.UnauthorizedError{APIError: &bk.APIError{StatusCode: 401}}, "failed to finish job"),
+			wantErr:   true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
+			codebuildSvc := &mocks.CodeBuildAPI{}
+			codebuildSvc.On("BatchGetBuilds", mock.AnythingOfType("*codebuild.BatchGetBuildsInput")).Return(&codebuild.BatchGetBuildsOutput{
+				Builds: []*codebuild.Build{
+					&codebuild.Build{
+						Id:          aws.String("buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba"),
+						BuildStatus: aws.String(tt.args.status),
+						Phases:      tt.phases,
+					},
+				},
+			}, nil)
+
+			buildkiteAPI := &mocks.API{}
+			buildkiteAPI.On("FinishJob", mocks.AccessToken("token123"), mock.AnythingOfType("*api.Job"), tt.wantSignalReason).Return(tt.finishErr)
+			buildkiteAPI.On("CreateAnnotation", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Annotation")).Return(nil)
+			buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
+
 			bkw := &CompletedJobHandler{
 				cfg:          cfg,
 				agentStore:   agentStore,
 				buildkiteAPI: buildkiteAPI,
 				logsReader:   logsReader,
+				codebuildSvc: codebuildSvc,
+			}
+
+			if tt.exitStatus != "" {
+				bucketCfg := *cfg
+				bucketCfg.ArtifactBucketName = "artifact-bucket"
+
+				bkw.cfg = &bucketCfg
+				bkw.s3Svc = &fakeS3{objects: map[string]string{"exit-status/abc123": tt.exitStatus}}
 			}
 
 			tt.args.evt.Codebuild.BuildStatus = tt.args.status
 			got, err := bkw.HandlerCompletedJob(tt.args.ctx, tt.args.evt)
-			if (err != nil) != tt.wantErr {
-				require.NotNil(t, err)
+			require.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
 				return
 			}
 			require.Equal(t, tt.want, got.Job.ExitStatus)
+			buildkiteAPI.AssertCalled(t, "CreateAnnotation", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Annotation"))
+
+			// infrastructure failures and timeouts are explained in the job log
+			if tt.wantMessage != "" {
+				buildkiteAPI.AssertCalled(t, "ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.MatchedBy(func(chunk *api.Chunk) bool {
+					return strings.Contains(chunk.Data, tt.wantMessage)
+				}))
+			} else {
+				buildkiteAPI.AssertNotCalled(t, "ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk"))
+			}
 		})
 	}
 }
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// commandExitStatus read the exit status of the buildkite bootstrap which the build writes to the bucket, returns an
+// empty string if the build didn't write one, for example when it failed before running the bootstrap
+func commandExitStatus(s3Svc s3iface.S3API, bucket string, evt *bk.WorkflowData) (string, error) {
+
+	key := bk.ExitStatusKey(evt.Job.ID)
+
+	res, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to get exit status %s", key)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read exit status %s", key)
+	}
+
+	exitStatus := strings.TrimSpace(string(data))
+
+	if _, err := strconv.Atoi(exitStatus); err != nil {
+		return "", errors.Errorf("invalid exit status %q in %s", exitStatus, key)
+	}
+
+	return exitStatus, nil
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+func Test_commandExitStatus(t *testing.T) {
+
+	evt := &bk.WorkflowData{Job: &api.Job{ID: "abc123"}}
+
+	exitStatus, err := commandExitStatus(&fakeS3{objects: map[string]string{"exit-status/abc123": "127\n"}}, "artifact-bucket", evt)
+	require.Nil(t, err)
+	require.Equal(t, "127", exitStatus)
+
+	// the build failed before running the bootstrap
+	exitStatus, err = commandExitStatus(&fakeS3{objects: map[string]string{}}, "artifact-bucket", evt)
+	require.Nil(t, err)
+	require.Equal(t, "", exitStatus)
+
+	_, err = commandExitStatus(&fakeS3{objects: map[string]string{"exit-status/abc123": "whoops"}}, "artifact-bucket", evt)
+	require.Error(t, err)
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,9 +12,10 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/aws-launch/pkg/cwlogs"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
 
-func uploadLogChunks(token string, buildkiteAPI bk.API, logsReader cwlogs.LogsReader, evt *bk.WorkflowData) error {
+func uploadLogChunks(agentConfig *api.Agent, buildkiteAPI bk.API, logsReader cwlogs.LogsReader, evt *bk.WorkflowData) error {
 
 	req := &cwlogs.ReadLogsParams{
 		GroupName:  evt.Codebuild.LogGroupName,
@@ -70,7 +73,7 @@ func uploadLogChunks(token string, buildkiteAPI bk.API, logsReader cwlogs.LogsRe
 				"n":       br,
 			}).Info("Read Chunk")
 
-			err = buildkiteAPI.ChunksUpload(token, evt.Job.ID, &api.Chunk{
+			err = buildkiteAPI.ChunksUpload(agentConfig, evt.Job.ID, &api.Chunk{
 				Data:     string(p[:br]),
 				Sequence: evt.LogSequence,
 				Offset:   evt.LogBytes,
@@ -97,3 +100,76 @@ func uploadLogChunks(token string, buildkiteAPI bk.API, logsReader cwlogs.LogsRe
 
 	return nil
 }
+
+// StepHandler handles a task in the codebuild job monitor step function
+type StepHandler func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error)
+
+// WithStepErrors return buildkite api errors unwrapped, the step function uses the name of the error type, for
+// example UnauthorizedError, to match errors in its retry and catch blocks
+func WithStepErrors(handler StepHandler) StepHandler {
+	return func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+		res, err := handler(ctx, evt)
+		if err == nil {
+			return res, nil
+		}
+
+		if _, ok := bk.AsAPIError(err); ok {
+			logrus.WithError(err).Error("buildkite api call failed")
+			return nil, errors.Cause(err)
+		}
+
+		return nil, err
+	}
+}
+
+// WithWorkflowStore load the job referenced by the workflow data before running the handler, then save any changes to
+// the job and remove it from the result so only the reference is passed to the next task. Jobs which are finished
+// are deleted as they are no longer needed.
+func WithWorkflowStore(workflowStore store.WorkflowStore, handler StepHandler) StepHandler {
+	return func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+
+		// the job is passed in the workflow data
+		if evt.JobRef == "" {
+			return handler(ctx, evt)
+		}
+
+		job, err := workflowStore.GetJob(evt.JobRef)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get job from workflow store")
+		}
+
+		before, err := json.Marshal(job)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal job")
+		}
+
+		evt.Job = job
+
+		res, err := handler(ctx, evt)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := json.Marshal(res.Job)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal job")
+		}
+
+		switch {
+		case res.Job.FinishedAt != "":
+			err = workflowStore.DeleteJob(res.JobRef)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to delete job from workflow store")
+			}
+		case !bytes.Equal(before, after):
+			err = workflowStore.SaveJob(res.JobRef, res.Job)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to save job to workflow store")
+			}
+		}
+
+		res.Job = nil
+
+		return res, nil
+	}
+}
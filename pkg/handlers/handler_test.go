@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	launchmocks "github.com/wolfeidau/aws-launch/mocks"
@@ -16,7 +18,7 @@ import (
 func Test_uploadLogChunks(t *testing.T) {
 
 	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("ChunksUpload", "token123", "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
 
 	logsReader := &launchmocks.LogsReader{}
 
@@ -52,7 +54,130 @@ func Test_uploadLogChunks(t *testing.T) {
 		NextToken: "nextToken",
 	}
 
-	err := uploadLogChunks("token123", buildkiteAPI, logsReader, evt)
+	err := uploadLogChunks(&api.Agent{AccessToken: "token123"}, buildkiteAPI, logsReader, evt)
 	require.Nil(t, err)
 	require.Equal(t, "f/34139340658027874184690460781927772298499668124394061824", evt.NextToken)
 }
+
+func TestWithStepErrors(t *testing.T) {
+
+	unauthorized := &bk.UnauthorizedError{APIError: &bk.APIError{StatusCode: 401}}
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name: "WithStepErrors() with success",
+		},
+		{
+			name:    "WithStepErrors() with buildkite api error",
+			err:     errors.Wrap(unauthorized, "failed to start job"),
+			wantErr: unauthorized,
+		},
+		{
+			name:    "WithStepErrors() with other error",
+			err:     errBoom,
+			wantErr: errBoom,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := WithStepErrors(func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return evt, nil
+			})
+
+			_, err := handler(context.TODO(), &bk.WorkflowData{})
+			require.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestWithWorkflowStore(t *testing.T) {
+
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name       string
+		evt        *bk.WorkflowData
+		update     func(job *api.Job)
+		err        error
+		wantMethod string
+		wantErr    error
+	}{
+		{
+			name:   "WithWorkflowStore() with job in workflow data",
+			evt:    &bk.WorkflowData{Job: &api.Job{ID: "abc123"}},
+			update: func(job *api.Job) { job.ExitStatus = "0" },
+		},
+		{
+			name:   "WithWorkflowStore() with unchanged job",
+			evt:    &bk.WorkflowData{JobRef: "abc123"},
+			update: func(job *api.Job) {},
+		},
+		{
+			name:       "WithWorkflowStore() with changed job",
+			evt:        &bk.WorkflowData{JobRef: "abc123"},
+			update:     func(job *api.Job) { job.StartedAt = "2019-05-01T10:00:00Z" },
+			wantMethod: "SaveJob",
+		},
+		{
+			name:       "WithWorkflowStore() with finished job",
+			evt:        &bk.WorkflowData{JobRef: "abc123"},
+			update:     func(job *api.Job) { job.FinishedAt = "2019-05-01T10:00:00Z" },
+			wantMethod: "DeleteJob",
+		},
+		{
+			name:    "WithWorkflowStore() with handler error",
+			evt:     &bk.WorkflowData{JobRef: "abc123"},
+			update:  func(job *api.Job) { job.StartedAt = "2019-05-01T10:00:00Z" },
+			err:     errBoom,
+			wantErr: errBoom,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			workflowStore := &mocks.WorkflowStore{}
+			workflowStore.On("GetJob", "abc123").Return(&api.Job{ID: "abc123"}, nil)
+			workflowStore.On("SaveJob", "abc123", mock.AnythingOfType("*api.Job")).Return(nil)
+			workflowStore.On("DeleteJob", "abc123").Return(nil)
+
+			handler := WithWorkflowStore(workflowStore, func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+				require.Equal(t, "abc123", evt.Job.ID)
+				tt.update(evt.Job)
+				return evt, tt.err
+			})
+
+			got, err := handler(context.TODO(), tt.evt)
+			require.Equal(t, tt.wantErr, err)
+			if tt.wantErr != nil {
+				workflowStore.AssertNotCalled(t, "SaveJob", mock.Anything, mock.Anything)
+				return
+			}
+
+			// jobs loaded from the workflow store are only passed on as a reference
+			if tt.evt.JobRef != "" {
+				require.Nil(t, got.Job)
+				workflowStore.AssertCalled(t, "GetJob", "abc123")
+			} else {
+				require.NotNil(t, got.Job)
+				workflowStore.AssertNotCalled(t, "GetJob", mock.Anything)
+			}
+
+			// changes are saved and finished jobs are deleted
+			if tt.wantMethod != "" {
+				require.Len(t, workflowStore.Calls, 2)
+				require.Equal(t, tt.wantMethod, workflowStore.Calls[1].Method)
+			} else {
+				workflowStore.AssertNotCalled(t, "SaveJob", mock.Anything, mock.Anything)
+				workflowStore.AssertNotCalled(t, "DeleteJob", mock.Anything)
+			}
+		})
+	}
+}
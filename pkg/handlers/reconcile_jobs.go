@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/statemachine"
+)
+
+// ReconcileJobsHandler reconcile the running job index with the step function executions
+type ReconcileJobsHandler struct {
+	cfg      *config.Config
+	executor statemachine.Executor
+}
+
+// NewReconcileJobsHandler create a new handler
+func NewReconcileJobsHandler(cfg *config.Config, sess *session.Session) *ReconcileJobsHandler {
+	return &ReconcileJobsHandler{
+		cfg:      cfg,
+		executor: statemachine.NewSFNExecutor(cfg, sess),
+	}
+}
+
+// HandlerReconcileJobs process the cloudwatch scheduled event
+func (rh *ReconcileJobsHandler) HandlerReconcileJobs(ctx context.Context, evt *events.CloudWatchEvent) error {
+
+	removed, err := rh.executor.ReconcileRunning()
+	if err != nil {
+		return errors.Wrap(err, "failed to reconcile running jobs")
+	}
+
+	logrus.WithField("removed", removed).Info("reconciled running jobs")
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+)
+
+func TestReconcileJobsHandler_HandlerReconcileJobs(t *testing.T) {
+
+	cfg := &config.Config{
+		EnvironmentName:   "dev",
+		EnvironmentNumber: "1",
+	}
+
+	tests := []struct {
+		name    string
+		removed int
+		err     error
+		wantErr bool
+	}{
+		{
+			name:    "reconcile with stale jobs",
+			removed: 2,
+			wantErr: false,
+		},
+		{
+			name:    "reconcile with executor failure",
+			err:     errors.New("whoops"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			executor := &mocks.Executor{}
+			executor.On("ReconcileRunning").Return(tt.removed, tt.err)
+
+			rh := &ReconcileJobsHandler{
+				cfg:      cfg,
+				executor: executor,
+			}
+
+			err := rh.HandlerReconcileJobs(context.TODO(), &events.CloudWatchEvent{})
+			require.Equal(t, tt.wantErr, err != nil)
+			executor.AssertExpectations(t)
+		})
+	}
+}
@@ -6,7 +6,9 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/buildkite/agent/api"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awscodebuild "github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/aws-launch/pkg/launcher"
@@ -23,10 +25,11 @@ type SubmitJobHandler struct {
 	agentStore   store.AgentsAPI
 	buildkiteAPI bk.API
 	lch          codebuild.LauncherAPI
+	codebuildSvc codebuildiface.CodeBuildAPI
 }
 
 // NewSubmitJobHandler create a new handler for submit job
-func NewSubmitJobHandler(cfg *config.Config, buildkiteAPI bk.API) *SubmitJobHandler {
+func NewSubmitJobHandler(cfg *config.Config, sess *session.Session, buildkiteAPI bk.API) *SubmitJobHandler {
 
 	config := aws.NewConfig()
 	lch := service.New(config).Codebuild
@@ -36,6 +39,7 @@ func NewSubmitJobHandler(cfg *config.Config, buildkiteAPI bk.API) *SubmitJobHand
 		agentStore:   store.NewAgents(cfg),
 		buildkiteAPI: buildkiteAPI,
 		lch:          lch,
+		codebuildSvc: awscodebuild.New(sess),
 	}
 }
 
@@ -51,7 +55,10 @@ func (sh *SubmitJobHandler) HandlerSubmitJob(ctx context.Context, evt *bk.Workfl
 		return nil, errors.Wrap(err, "failed to load agent from store")
 	}
 
-	err = sh.buildkiteAPI.StartJob(agent.AgentConfig.AccessToken, evt.Job)
+	// jobs accepted before the access token was rotated use the previous agent config
+	agentConfig := agent.AgentConfigFor(evt.AgentTokenID)
+
+	err = sh.buildkiteAPI.StartJob(agentConfig, evt.Job)
 	if err != nil {
 		return nil, err
 	}
@@ -59,11 +66,17 @@ func (sh *SubmitJobHandler) HandlerSubmitJob(ctx context.Context, evt *bk.Workfl
 	logger.Info("Starting codebuild task")
 
 	// update the job with the agent access token
-	evt.UpdateBuildJobCreds(agent.AgentConfig.AccessToken)
+	evt.UpdateBuildJobCreds(agentConfig.AccessToken)
 
 	// update the environment information
 	evt.UpdateEnvironment(sh.cfg.EnvironmentName, sh.cfg.EnvironmentNumber)
 
+	// the build writes artifacts, and the exit status of the command, for the job to the artifact bucket
+	if sh.cfg.ArtifactBucketName != "" {
+		evt.UpdateArtifactPrefix()
+		evt.UpdateExitStatusKey()
+	}
+
 	// start a build job
 	build, err := sh.startBuildAndHandleAWSError(evt)
 	if err != nil {
@@ -77,7 +90,7 @@ func (sh *SubmitJobHandler) HandlerSubmitJob(ctx context.Context, evt *bk.Workfl
 		return nil, errors.Wrap(err, "failed to update cloudwatch logs group and stream names")
 	}
 
-	err = sh.uploadBuildMessage(agent.AgentConfig.AccessToken, build.buildMessage(), evt)
+	err = evt.UploadMessage(sh.buildkiteAPI, agentConfig, build.buildMessage())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to upload build message logs")
 	}
@@ -116,7 +129,17 @@ func (sh *SubmitJobHandler) startBuildAndHandleAWSError(evt *bk.WorkflowData) (*
 
 	sh.getLog(evt).WithField("params", startBuildInput).Info("LaunchTask")
 
-	startResult, err := sh.lch.LaunchTask(startBuildInput)
+	var (
+		startResult *codebuild.LaunchTaskResult
+		err         error
+	)
+
+	// the build is stopped by codebuild if the job exceeds the timeout assigned in the pipeline
+	if timeout := evt.JobTimeout(); timeout > 0 {
+		startResult, err = launchTaskWithTimeout(sh.codebuildSvc, startBuildInput, timeout)
+	} else {
+		startResult, err = sh.lch.LaunchTask(startBuildInput)
+	}
 	if err != nil {
 		// extract the cause using pkg/errors as this may be a part of an error trace created by this library
 		switch err := errors.Cause(err).(type) {
@@ -144,21 +167,3 @@ func (sh *SubmitJobHandler) startBuildAndHandleAWSError(evt *bk.WorkflowData) (*
 		headerMsg:   "Started a job in codebuild on :aws:",
 	}, nil
 }
-
-func (sh *SubmitJobHandler) uploadBuildMessage(token, msg string, evt *bk.WorkflowData) error {
-	err := sh.buildkiteAPI.ChunksUpload(token, evt.Job.ID, &api.Chunk{
-		Data:     msg,
-		Sequence: evt.LogSequence,
-		Offset:   evt.LogBytes,
-		Size:     len(msg),
-	})
-	if err != nil {
-		return err
-	}
-
-	// increment everything
-	evt.LogSequence++
-	evt.LogBytes += len(msg)
-
-	return nil
-}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/buildkite/agent/api"
@@ -38,12 +39,13 @@ func TestSubmitHandler_HandlerSubmitJob(t *testing.T) {
 	)
 
 	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("StartJob", "token123", mock.AnythingOfType("*api.Job")).Return(nil)
-	buildkiteAPI.On("ChunksUpload", "token123", "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
+	buildkiteAPI.On("StartJob", mocks.AccessToken("token123"), mock.AnythingOfType("*api.Job")).Return(nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
 
 	cfg := &config.Config{
-		EnvironmentName:   "dev",
-		EnvironmentNumber: "1",
+		EnvironmentName:    "dev",
+		EnvironmentNumber:  "1",
+		ArtifactBucketName: "artifact-bucket",
 	}
 
 	evt := &bk.WorkflowData{
@@ -76,6 +78,8 @@ func TestSubmitHandler_HandlerSubmitJob(t *testing.T) {
 	require.Equal(t, "abc123", got.Job.ID)
 	require.Equal(t, "dev", got.Job.Env["ENVIRONMENT_NAME"])
 	require.Equal(t, "1", got.Job.Env["ENVIRONMENT_NUMBER"])
+	require.Equal(t, "artifacts/abc123/", got.Job.Env["ARTIFACT_PREFIX"])
+	require.Equal(t, "exit-status/abc123", got.Job.Env["EXIT_STATUS_KEY"])
 
 }
 
@@ -90,8 +94,8 @@ func TestSubmitHandler_HandlerSubmitJob_ErrNotFound(t *testing.T) {
 	}, nil)
 
 	buildkiteAPI := &mocks.API{}
-	buildkiteAPI.On("StartJob", "token123", mock.AnythingOfType("*api.Job")).Return(nil)
-	buildkiteAPI.On("ChunksUpload", "token123", "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
+	buildkiteAPI.On("StartJob", mocks.AccessToken("token123"), mock.AnythingOfType("*api.Job")).Return(nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
 
 	lch := new(codebuildmock.LauncherAPI)
 	notFoundErr := awserr.New(codebuild.ErrCodeResourceNotFoundException, "woops", errors.New("woops"))
@@ -132,3 +136,61 @@ func TestSubmitHandler_HandlerSubmitJob_ErrNotFound(t *testing.T) {
 	require.Equal(t, "ted", got.AgentName)
 	require.Equal(t, "abc123", got.Job.ID)
 }
+
+func TestSubmitHandler_HandlerSubmitJob_Timeout(t *testing.T) {
+	agentStore := &mocks.AgentsAPI{}
+
+	agentStore.On("Get", "ted").Return(&store.AgentRecord{
+		Name: "ted",
+		AgentConfig: &api.Agent{
+			AccessToken: "token123",
+		},
+	}, nil)
+
+	buildkiteAPI := &mocks.API{}
+	buildkiteAPI.On("StartJob", mocks.AccessToken("token123"), mock.AnythingOfType("*api.Job")).Return(nil)
+	buildkiteAPI.On("ChunksUpload", mocks.AccessToken("token123"), "abc123", mock.AnythingOfType("*api.Chunk")).Return(nil)
+
+	// jobs with a timeout are started directly with a timeout override
+	codebuildSvc := &mocks.CodeBuildAPI{}
+	codebuildSvc.On("StartBuild", mock.MatchedBy(func(input *codebuild.StartBuildInput) bool {
+		return aws.StringValue(input.ProjectName) == "testproject-1" && aws.Int64Value(input.TimeoutInMinutesOverride) == 10
+	})).Return(&codebuild.StartBuildOutput{
+		Build: &codebuild.Build{
+			Id:          aws.String("buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba"),
+			BuildStatus: aws.String(codebuild.StatusTypeInProgress),
+		},
+	}, nil)
+
+	cfg := &config.Config{
+		EnvironmentName:   "dev",
+		EnvironmentNumber: "1",
+	}
+
+	evt := &bk.WorkflowData{
+		AgentName: "ted",
+		Job: &api.Job{
+			ID:  "abc123",
+			Env: map[string]string{"BUILDKITE_TIMEOUT": "10"},
+		},
+		Codebuild: &bk.CodebuildWorkflowData{
+			ProjectName: "testproject-1",
+		},
+	}
+
+	sh := &SubmitJobHandler{
+		cfg:          cfg,
+		agentStore:   agentStore,
+		buildkiteAPI: buildkiteAPI,
+		lch:          new(codebuildmock.LauncherAPI),
+		codebuildSvc: codebuildSvc,
+	}
+
+	got, err := sh.HandlerSubmitJob(context.TODO(), evt)
+	require.Nil(t, err)
+
+	require.Equal(t, "buildkite-dev-1:58df10ab-9dc5-4c7f-b0c3-6a02b63306ba", got.Codebuild.BuildID)
+	require.Equal(t, "IN_PROGRESS", got.Codebuild.BuildStatus)
+	require.Equal(t, "RUNNING", got.TaskStatus)
+	codebuildSvc.AssertExpectations(t)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codebuild/codebuildiface"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wolfeidau/aws-launch/pkg/launcher"
+	cblauncher "github.com/wolfeidau/aws-launch/pkg/launcher/codebuild"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// limits on the timeout of a codebuild build in minutes
+const (
+	minBuildTimeout = 5
+	maxBuildTimeout = 2160
+)
+
+// buildTimeout convert the job timeout to a codebuild build timeout in minutes, codebuild only supports timeouts
+// between 5 and 2160 minutes, shorter timeouts are enforced by the check job handler
+func buildTimeout(timeout time.Duration) int64 {
+	minutes := int64((timeout + time.Minute - 1) / time.Minute)
+
+	switch {
+	case minutes < minBuildTimeout:
+		return minBuildTimeout
+	case minutes > maxBuildTimeout:
+		return maxBuildTimeout
+	default:
+		return minutes
+	}
+}
+
+// launchTaskWithTimeout start the codebuild build with the timeout of the job, the launcher doesn't support
+// overriding the timeout so the build is started directly
+func launchTaskWithTimeout(codebuildSvc codebuildiface.CodeBuildAPI, params *cblauncher.LaunchTaskParams, timeout time.Duration) (*cblauncher.LaunchTaskResult, error) {
+
+	res, err := codebuildSvc.StartBuild(&codebuild.StartBuildInput{
+		ProjectName:                  aws.String(params.ProjectName),
+		EnvironmentVariablesOverride: environmentVariables(params.Environment),
+		ImageOverride:                params.Image,
+		ComputeTypeOverride:          params.ComputeType,
+		PrivilegedModeOverride:       params.PrivilegedMode,
+		ServiceRoleOverride:          params.ServiceRole,
+		TimeoutInMinutesOverride:     aws.Int64(buildTimeout(timeout)),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start build")
+	}
+
+	return &cblauncher.LaunchTaskResult{
+		ID:          aws.StringValue(res.Build.Id),
+		TaskStatus:  taskStatus(aws.StringValue(res.Build.BuildStatus)),
+		BuildArn:    aws.StringValue(res.Build.Arn),
+		BuildStatus: aws.StringValue(res.Build.BuildStatus),
+	}, nil
+}
+
+func environmentVariables(env map[string]string) []*codebuild.EnvironmentVariable {
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	vars := make([]*codebuild.EnvironmentVariable, len(names))
+	for n, name := range names {
+		vars[n] = &codebuild.EnvironmentVariable{Name: aws.String(name), Value: aws.String(env[name])}
+	}
+
+	return vars
+}
+
+// taskStatus normalise the codebuild build status in the same way as the launcher
+func taskStatus(buildStatus string) string {
+	switch buildStatus {
+	case codebuild.StatusTypeStopped:
+		return launcher.TaskStopped
+	case codebuild.StatusTypeInProgress:
+		return launcher.TaskRunning
+	case codebuild.StatusTypeSucceeded:
+		return launcher.TaskSucceeded
+	default:
+		return launcher.TaskFailed
+	}
+}
+
+// stopTimedOutBuild stop the codebuild build for a job which exceeded its timeout and explain why in the job log,
+// the job is flagged as timed out so it is finished with ExitStatusTimedOut
+func stopTimedOutBuild(lch cblauncher.LauncherAPI, buildkiteAPI bk.API, agentConfig *api.Agent, evt *bk.WorkflowData) error {
+
+	// already stopped on a previous check
+	if evt.TimedOut {
+		return nil
+	}
+
+	stopRes, err := lch.StopTask(&cblauncher.StopTaskParams{
+		ID: evt.Codebuild.BuildID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to stop codebuild job")
+	}
+
+	logrus.WithFields(
+		logrus.Fields{
+			"projectName":     evt.Codebuild.ProjectName,
+			"id":              evt.Codebuild.BuildID,
+			"CodebuildStatus": stopRes.BuildStatus,
+			"timeout":         evt.JobTimeout(),
+		},
+	).Info("stopped timed out build")
+
+	evt.UpdateCodebuildStatus(evt.Codebuild.BuildID, stopRes.BuildStatus, stopRes.TaskStatus)
+
+	evt.TimedOut = true
+
+	msg := fmt.Sprintf("--- :alarm_clock: Job timed out after %d minutes, stopped codebuild build\nbuild_id=%s\n",
+		int(evt.JobTimeout().Minutes()), evt.Codebuild.BuildID)
+
+	err = evt.UploadMessage(buildkiteAPI, agentConfig, msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload timed out message")
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    int64
+	}{
+		{name: "buildTimeout() with timeout below the codebuild minimum", timeout: time.Minute, want: 5},
+		{name: "buildTimeout() with partial minutes", timeout: 90*time.Minute + time.Second, want: 91},
+		{name: "buildTimeout() with timeout of 24 hours", timeout: 24 * time.Hour, want: 1440},
+		{name: "buildTimeout() with timeout above the codebuild maximum", timeout: 48 * time.Hour, want: 2160},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, buildTimeout(tt.timeout))
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package statemachine
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/aws-launch/pkg/launcher"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// names of the states in the codebuild job monitor state machine
+const (
+	SubmitJobState   = "Submit Job"
+	WaitState        = "Wait X Seconds"
+	CheckJobState    = "Get Job Status"
+	JobCompleteState = "Job Complete?"
+	CompleteJobState = "Get Final Job Status"
+)
+
+// types of states supported by the definition
+const (
+	StateTypeTask   = "Task"
+	StateTypeWait   = "Wait"
+	StateTypeChoice = "Choice"
+)
+
+// ErrorAll matches any error raised by a state
+const ErrorAll = "States.ALL"
+
+// paths of the workflow data used by the state machine, these match the json tags of bk.WorkflowData
+const (
+	WaitTimePath   = "$.wait_time"
+	TaskStatusPath = "$.task_status"
+	TaskErrorPath  = "$.task_error"
+)
+
+// CompletedTaskStatuses jobs are completed once the build reaches one of these task statuses
+var CompletedTaskStatuses = []string{launcher.TaskStopped, launcher.TaskFailed, launcher.TaskSucceeded}
+
+// Definition step function state machine definition in the amazon states language
+type Definition struct {
+	Comment string            `json:"Comment,omitempty"`
+	StartAt string            `json:"StartAt"`
+	States  map[string]*State `json:"States"`
+}
+
+// State a state in the state machine, only the fields used by the job monitor are supported
+type State struct {
+	Type        string        `json:"Type"`
+	Resource    string        `json:"Resource,omitempty"`
+	SecondsPath string        `json:"SecondsPath,omitempty"`
+	Choices     []*ChoiceRule `json:"Choices,omitempty"`
+	Default     string        `json:"Default,omitempty"`
+	Next        string        `json:"Next,omitempty"`
+	End         bool          `json:"End,omitempty"`
+	Retry       []*Retrier    `json:"Retry,omitempty"`
+	Catch       []*Catcher    `json:"Catch,omitempty"`
+}
+
+// ChoiceRule move to the next state when the variable equals the string
+type ChoiceRule struct {
+	Variable     string `json:"Variable"`
+	StringEquals string `json:"StringEquals"`
+	Next         string `json:"Next"`
+}
+
+// Retrier retry policy for errors raised by a task
+type Retrier struct {
+	ErrorEquals     []string `json:"ErrorEquals"`
+	IntervalSeconds int      `json:"IntervalSeconds,omitempty"`
+	MaxAttempts     int      `json:"MaxAttempts"`
+	BackoffRate     float64  `json:"BackoffRate,omitempty"`
+}
+
+// Catcher move to the next state when a task fails, the error is stored at the result path
+type Catcher struct {
+	ErrorEquals []string `json:"ErrorEquals"`
+	Next        string   `json:"Next"`
+	ResultPath  string   `json:"ResultPath,omitempty"`
+}
+
+// JobMonitorResources the lambda functions invoked by the codebuild job monitor
+type JobMonitorResources struct {
+	SubmitJobArn   string
+	CheckJobArn    string
+	CompleteJobArn string
+}
+
+// NewJobMonitorDefinition build the definition of the state machine which submits a codebuild job and monitors the
+// job until it completes
+func NewJobMonitorDefinition(resources *JobMonitorResources) *Definition {
+
+	choices := []*ChoiceRule{}
+	for _, taskStatus := range CompletedTaskStatuses {
+		choices = append(choices, &ChoiceRule{Variable: TaskStatusPath, StringEquals: taskStatus, Next: CompleteJobState})
+	}
+
+	return &Definition{
+		Comment: "A state machine that submits a codebuild Job and monitors the Job until it completes.",
+		StartAt: SubmitJobState,
+		States: map[string]*State{
+			SubmitJobState: {
+				Type:     StateTypeTask,
+				Resource: resources.SubmitJobArn,
+				Next:     WaitState,
+				Retry:    apiRetriers(),
+				Catch:    completeJobCatchers(),
+			},
+			WaitState: {
+				Type:        StateTypeWait,
+				SecondsPath: WaitTimePath,
+				Next:        CheckJobState,
+			},
+			CheckJobState: {
+				Type:     StateTypeTask,
+				Resource: resources.CheckJobArn,
+				Next:     JobCompleteState,
+				Retry:    apiRetriers(),
+				Catch:    completeJobCatchers(),
+			},
+			JobCompleteState: {
+				Type:    StateTypeChoice,
+				Choices: choices,
+				Default: WaitState,
+			},
+			CompleteJobState: {
+				Type:     StateTypeTask,
+				Resource: resources.CompleteJobArn,
+				End:      true,
+				Retry:    apiRetriers(),
+			},
+		},
+	}
+}
+
+// apiRetriers errors which won't succeed when retried, such as a revoked access token, fail straight away
+func apiRetriers() []*Retrier {
+	return []*Retrier{
+		{
+			ErrorEquals: []string{errorType(&bk.UnauthorizedError{}), errorType(&bk.NotFoundError{})},
+			MaxAttempts: 0,
+		},
+		{
+			ErrorEquals:     []string{ErrorAll},
+			IntervalSeconds: 1,
+			MaxAttempts:     3,
+			BackoffRate:     2,
+		},
+	}
+}
+
+// completeJobCatchers the job is always completed so buildkite is told the outcome, the error is kept apart from the
+// task status as the catcher writes an object with the error and cause
+func completeJobCatchers() []*Catcher {
+	return []*Catcher{
+		{
+			ErrorEquals: []string{ErrorAll},
+			Next:        CompleteJobState,
+			ResultPath:  TaskErrorPath,
+		},
+	}
+}
+
+// errorType name of the error as reported by the lambda runtime, which is the name of the type
+func errorType(err error) string {
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
+
+// Validate check the states referenced by the definition exist, each state is reachable and each state either moves
+// to another state or ends the execution
+func (d *Definition) Validate() error {
+
+	if _, ok := d.States[d.StartAt]; !ok {
+		return errors.Errorf("start state %q doesn't exist", d.StartAt)
+	}
+
+	reachable := map[string]bool{d.StartAt: true}
+
+	for name, state := range d.States {
+
+		next := []string{}
+
+		switch state.Type {
+		case StateTypeChoice:
+			if len(state.Choices) == 0 {
+				return errors.Errorf("choice state %q has no choices", name)
+			}
+			for _, choice := range state.Choices {
+				next = append(next, choice.Next)
+			}
+			if state.Default != "" {
+				next = append(next, state.Default)
+			}
+		case StateTypeTask, StateTypeWait:
+			if (state.Next == "") == !state.End {
+				return errors.Errorf("state %q must have either a next state or end", name)
+			}
+			if state.Type == StateTypeTask && state.Resource == "" {
+				return errors.Errorf("task state %q has no resource", name)
+			}
+			if state.Next != "" {
+				next = append(next, state.Next)
+			}
+		default:
+			return errors.Errorf("state %q has unsupported type %q", name, state.Type)
+		}
+
+		for _, catcher := range state.Catch {
+			next = append(next, catcher.Next)
+		}
+
+		for _, nextName := range next {
+			if _, ok := d.States[nextName]; !ok {
+				return errors.Errorf("state %q moves to state %q which doesn't exist", name, nextName)
+			}
+			reachable[nextName] = true
+		}
+	}
+
+	for name := range d.States {
+		if !reachable[name] {
+			return errors.Errorf("state %q isn't reachable", name)
+		}
+	}
+
+	return nil
+}
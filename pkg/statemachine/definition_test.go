@@ -0,0 +1,109 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+var resources = &JobMonitorResources{
+	SubmitJobArn:   "${SfnSubmitLambdaARN}",
+	CheckJobArn:    "${SfnCheckLambdaARN}",
+	CompleteJobArn: "${SfnCompleteLambdaARN}",
+}
+
+func TestNewJobMonitorDefinition(t *testing.T) {
+
+	definition := NewJobMonitorDefinition(resources)
+	require.Nil(t, definition.Validate())
+
+	// the paths used by the state machine must exist in the workflow data
+	tags := map[string]bool{}
+	workflowData := reflect.TypeOf(bk.WorkflowData{})
+	for i := 0; i < workflowData.NumField(); i++ {
+		tags["$."+strings.Split(workflowData.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+
+	require.True(t, tags[WaitTimePath])
+	require.True(t, tags[TaskStatusPath])
+	require.True(t, tags[TaskErrorPath])
+
+	data, err := json.Marshal(definition)
+	require.Nil(t, err)
+
+	require.JSONEq(t, string(data), deployedDefinition(t))
+}
+
+func TestDefinition_Validate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		update  func(*Definition)
+		wantErr string
+	}{
+		{
+			name:   "Validate() with job monitor",
+			update: func(*Definition) {},
+		},
+		{
+			name:    "Validate() with missing start state",
+			update:  func(d *Definition) { d.StartAt = "Start" },
+			wantErr: `start state "Start" doesn't exist`,
+		},
+		{
+			name:    "Validate() with missing next state",
+			update:  func(d *Definition) { d.States[WaitState].Next = "Check" },
+			wantErr: `state "Wait X Seconds" moves to state "Check" which doesn't exist`,
+		},
+		{
+			name:    "Validate() with next state and end",
+			update:  func(d *Definition) { d.States[CompleteJobState].Next = WaitState },
+			wantErr: `state "Get Final Job Status" must have either a next state or end`,
+		},
+		{
+			name:    "Validate() with unreachable state",
+			update:  func(d *Definition) { d.States["Unused"] = &State{Type: StateTypeWait, End: true} },
+			wantErr: `state "Unused" isn't reachable`,
+		},
+		{
+			name:    "Validate() with unsupported state type",
+			update:  func(d *Definition) { d.States[WaitState].Type = "Parallel" },
+			wantErr: `state "Wait X Seconds" has unsupported type "Parallel"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			definition := NewJobMonitorDefinition(resources)
+			tt.update(definition)
+
+			err := definition.Validate()
+			if tt.wantErr == "" {
+				require.Nil(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+// deployedDefinition extract the definition of the state machine from the deployment template
+func deployedDefinition(t *testing.T) string {
+
+	data, err := ioutil.ReadFile("../../deploy.sam.yml")
+	require.Nil(t, err)
+
+	template := string(data)
+
+	start := strings.Index(template, "DefinitionString:")
+	require.NotEqual(t, -1, start)
+
+	start += strings.Index(template[start:], "{")
+	end := start + strings.Index(template[start:], "\n          - SfnSubmitLambdaARN")
+
+	return template[start:end]
+}
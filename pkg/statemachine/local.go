@@ -0,0 +1,417 @@
+package statemachine
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// localStateMachineArn the arn used to name executions run by the local executor
+const localStateMachineArn = "arn:aws:states:local:000000000000:stateMachine:CodebuildJobMonitor"
+
+// finished executions are kept for this long so the jobs they ran can still be found, for example when the job is
+// canceled just after it completes
+const localRetention = 10 * time.Minute
+
+// Task a task of the codebuild job monitor, this matches the step handlers invoked by the state machine
+type Task func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error)
+
+// LocalTasks the tasks run by the local executor
+type LocalTasks struct {
+	SubmitJob   Task
+	CheckJob    Task
+	CompleteJob Task
+}
+
+// LocalExecutor run the codebuild job monitor in this process rather than step functions, this is used to run the
+// agent as a single long lived process during development and to drive it in integration tests. Executions are only
+// tracked in memory so they are lost when the process exits, finished executions are evicted after a short retention
+// period.
+type LocalExecutor struct {
+	tasks *LocalTasks
+	wait  time.Duration
+
+	// retry intervals are in seconds in the state machine, tests shorten this
+	retryUnit time.Duration
+
+	// how long finished executions are kept before they are evicted
+	retention time.Duration
+
+	mu         sync.Mutex
+	executions map[string]*localExecution
+	running    sync.WaitGroup
+}
+
+type localExecution struct {
+	agentName string
+	item      *sfn.ExecutionListItem
+	data      []byte
+	cancel    context.CancelFunc
+}
+
+// NewLocalExecutor create a new local executor, the job is checked after waiting for the given time, or the wait time
+// of the job if this is zero
+func NewLocalExecutor(tasks *LocalTasks, wait time.Duration) *LocalExecutor {
+	return &LocalExecutor{
+		tasks:      tasks,
+		wait:       wait,
+		retryUnit:  time.Second,
+		retention:  localRetention,
+		executions: map[string]*localExecution{},
+	}
+}
+
+// RunningForAgent return the number of running executions for a given agent
+func (le *LocalExecutor) RunningForAgent(agentName string) (int, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.evict()
+
+	running := 0
+
+	for _, exec := range le.executions {
+		if exec.agentName == agentName && aws.StringValue(exec.item.Status) == sfn.ExecutionStatusRunning {
+			running++
+		}
+	}
+
+	return running, nil
+}
+
+// StartExecution start an execution named after the job in a goroutine, if the job already has an execution it is
+// left running
+func (le *LocalExecutor) StartExecution(agentName string, job *api.Job, jsonData []byte) error {
+
+	err := json.Unmarshal(jsonData, new(bk.WorkflowData))
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal workflow data")
+	}
+
+	execName := executionName(job.ID)
+	execArn := executionArn(localStateMachineArn, execName)
+
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.evict()
+
+	if _, ok := le.executions[execArn]; ok {
+		logrus.WithFields(logrus.Fields{
+			"ID":           job.ID,
+			"Name":         execName,
+			"ExecutionArn": execArn,
+		}).Warn("execution already exists")
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	le.executions[execArn] = &localExecution{
+		agentName: agentName,
+		item: &sfn.ExecutionListItem{
+			ExecutionArn:    aws.String(execArn),
+			Name:            aws.String(execName),
+			StateMachineArn: aws.String(localStateMachineArn),
+			Status:          aws.String(sfn.ExecutionStatusRunning),
+			StartDate:       aws.Time(nowFunc()),
+		},
+		data:   jsonData,
+		cancel: cancel,
+	}
+
+	le.running.Add(1)
+	go le.run(ctx, execArn)
+
+	logrus.WithFields(logrus.Fields{
+		"ID":           job.ID,
+		"Name":         execName,
+		"ExecutionArn": execArn,
+	}).Info("started execution")
+
+	return nil
+}
+
+// GetExecutionData return the workflow data output by the most recent task of the execution, or the execution input
+// if it hasn't completed a task yet
+func (le *LocalExecutor) GetExecutionData(executionArn string) ([]byte, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	exec, ok := le.executions[executionArn]
+	if !ok {
+		return nil, errors.Errorf("execution doesn't exist: %s", executionArn)
+	}
+
+	return exec.data, nil
+}
+
+// StopExecution abort a running execution, the task being run is passed a cancelled context
+func (le *LocalExecutor) StopExecution(executionArn, cause string) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	exec, ok := le.executions[executionArn]
+	if !ok {
+		return errors.Errorf("execution doesn't exist: %s", executionArn)
+	}
+
+	if aws.StringValue(exec.item.Status) != sfn.ExecutionStatusRunning {
+		return nil
+	}
+
+	exec.item.Status = aws.String(sfn.ExecutionStatusAborted)
+	exec.item.StopDate = aws.Time(nowFunc())
+	exec.cancel()
+
+	logrus.WithFields(logrus.Fields{
+		"ExecutionArn": executionArn,
+		"cause":        cause,
+	}).Info("stopped execution")
+
+	return nil
+}
+
+// ReconcileRunning local executions aren't added to the running job index so there is nothing to reconcile
+func (le *LocalExecutor) ReconcileRunning() (int, error) {
+	return 0, nil
+}
+
+// FindByJobID find the execution tracking the buildkite job, this returns nil if the job doesn't have an execution
+func (le *LocalExecutor) FindByJobID(jobID string) (*sfn.ExecutionListItem, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	exec, ok := le.executions[executionArn(localStateMachineArn, executionName(jobID))]
+	if !ok {
+		return nil, nil
+	}
+
+	item := *exec.item
+
+	return &item, nil
+}
+
+// Wait block until all the executions have finished
+func (le *LocalExecutor) Wait() {
+	le.running.Wait()
+}
+
+// run the execution following the states of the job monitor, the job is submitted then checked until the build
+// completes, failed tasks move straight to completing the job so buildkite is told the outcome
+func (le *LocalExecutor) run(ctx context.Context, execArn string) {
+	defer le.running.Done()
+
+	evt, err := le.runTask(ctx, execArn, SubmitJobState, le.tasks.SubmitJob)
+	for err == nil && !completed(evt.TaskStatus) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(le.waitTime(evt)):
+		}
+
+		evt, err = le.runTask(ctx, execArn, CheckJobState, le.tasks.CheckJob)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		logrus.WithError(err).WithField("ExecutionArn", execArn).Error("job monitor task failed")
+
+		err = le.catch(execArn, err)
+		if err != nil {
+			le.finish(execArn, sfn.ExecutionStatusFailed)
+			return
+		}
+	}
+
+	_, err = le.runTask(ctx, execArn, CompleteJobState, le.tasks.CompleteJob)
+	if err != nil {
+		logrus.WithError(err).WithField("ExecutionArn", execArn).Error("job monitor task failed")
+
+		le.finish(execArn, sfn.ExecutionStatusFailed)
+		return
+	}
+
+	le.finish(execArn, sfn.ExecutionStatusSucceeded)
+}
+
+// runTask run the task passing it the output of the previous task, as the state machine passes the tasks json, errors
+// are retried using the retry policy of the state machine
+func (le *LocalExecutor) runTask(ctx context.Context, execArn, state string, task Task) (*bk.WorkflowData, error) {
+
+	for attempt := 0; ; attempt++ {
+
+		evt, err := le.executionData(execArn)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := task(ctx, evt)
+		if err == nil {
+			return res, le.setExecutionData(execArn, res)
+		}
+
+		wait, retry := le.retryWait(err, attempt)
+		if !retry || ctx.Err() != nil {
+			return nil, errors.Wrapf(err, "%s failed", state)
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"ExecutionArn": execArn,
+			"state":        state,
+			"wait":         wait,
+		}).Warn("retrying task")
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(err, "%s failed", state)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryWait how long to wait before retrying the task using the first retrier of the state machine which matches the
+// error, false is returned if the error isn't retried
+func (le *LocalExecutor) retryWait(err error, attempt int) (time.Duration, bool) {
+
+	name := errorType(errors.Cause(err))
+
+	for _, retrier := range apiRetriers() {
+		if !matchesError(retrier.ErrorEquals, name) {
+			continue
+		}
+
+		if attempt >= retrier.MaxAttempts {
+			return 0, false
+		}
+
+		interval := float64(retrier.IntervalSeconds) * math.Pow(retrier.BackoffRate, float64(attempt))
+
+		return time.Duration(interval * float64(le.retryUnit)), true
+	}
+
+	return 0, false
+}
+
+// catch store the error and its cause as the task error, as the catcher of the state machine does before the job is
+// completed
+func (le *LocalExecutor) catch(execArn string, taskErr error) error {
+
+	evt, err := le.executionData(execArn)
+	if err != nil {
+		return err
+	}
+
+	evt.TaskError = &bk.TaskError{Error: errorType(errors.Cause(taskErr)), Cause: taskErr.Error()}
+
+	return le.setExecutionData(execArn, evt)
+}
+
+func (le *LocalExecutor) waitTime(evt *bk.WorkflowData) time.Duration {
+	if le.wait > 0 {
+		return le.wait
+	}
+
+	return time.Duration(evt.WaitTime) * time.Second
+}
+
+func (le *LocalExecutor) executionData(execArn string) (*bk.WorkflowData, error) {
+
+	data, err := le.GetExecutionData(execArn)
+	if err != nil {
+		return nil, err
+	}
+
+	evt := new(bk.WorkflowData)
+
+	err = json.Unmarshal(data, evt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal workflow data")
+	}
+
+	return evt, nil
+}
+
+func (le *LocalExecutor) setExecutionData(execArn string, evt *bk.WorkflowData) error {
+
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal workflow data")
+	}
+
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	exec, ok := le.executions[execArn]
+	if !ok {
+		return errors.Errorf("execution doesn't exist: %s", execArn)
+	}
+
+	exec.data = data
+
+	return nil
+}
+
+// finish record the outcome of the execution, unless it was stopped
+func (le *LocalExecutor) finish(execArn, status string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	exec, ok := le.executions[execArn]
+	if !ok || aws.StringValue(exec.item.Status) != sfn.ExecutionStatusRunning {
+		return
+	}
+
+	exec.item.Status = aws.String(status)
+	exec.item.StopDate = aws.Time(nowFunc())
+
+	logrus.WithFields(logrus.Fields{
+		"ExecutionArn": execArn,
+		"status":       status,
+	}).Info("execution finished")
+}
+
+// evict remove executions which finished longer ago than the retention period so executions don't accumulate in a
+// long lived process, the lock must be held
+func (le *LocalExecutor) evict() {
+	cutoff := nowFunc().Add(-le.retention)
+
+	for execArn, exec := range le.executions {
+		if exec.item.StopDate != nil && exec.item.StopDate.Before(cutoff) {
+			delete(le.executions, execArn)
+		}
+	}
+}
+
+func completed(taskStatus string) bool {
+	for _, status := range CompletedTaskStatuses {
+		if taskStatus == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesError(errorEquals []string, name string) bool {
+	for _, errorName := range errorEquals {
+		if errorName == ErrorAll || errorName == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,239 @@
+package statemachine
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/aws-launch/pkg/launcher"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/bk"
+)
+
+// fakeTasks records the tasks run by the local executor, the build succeeds on the second check
+type fakeTasks struct {
+	mu             sync.Mutex
+	calls          []string
+	submitErrs     []error
+	completeErr    error
+	completeStatus string
+	completeError  *bk.TaskError
+	checked        chan struct{}
+	checkStatus    string
+}
+
+func (ft *fakeTasks) tasks() *LocalTasks {
+	return &LocalTasks{
+		SubmitJob: func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+			ft.record(SubmitJobState)
+			if len(ft.submitErrs) > 0 {
+				err := ft.submitErrs[0]
+				ft.submitErrs = ft.submitErrs[1:]
+				return nil, err
+			}
+			evt.TaskStatus = launcher.TaskRunning
+			evt.WaitTime = bk.DefaultWaitTime
+			return evt, nil
+		},
+		CheckJob: func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+			checks := ft.record(CheckJobState)
+			evt.TaskStatus = ft.checkStatus
+			if evt.TaskStatus == "" && checks == 2 {
+				evt.TaskStatus = launcher.TaskSucceeded
+			}
+			if ft.checked != nil {
+				select {
+				case ft.checked <- struct{}{}:
+				case <-ctx.Done():
+				}
+			}
+			return evt, nil
+		},
+		CompleteJob: func(ctx context.Context, evt *bk.WorkflowData) (*bk.WorkflowData, error) {
+			ft.record(CompleteJobState)
+			ft.completeStatus = evt.TaskStatus
+			ft.completeError = evt.TaskError
+			return evt, ft.completeErr
+		},
+	}
+}
+
+// record the task returning the number of times it has run
+func (ft *fakeTasks) record(state string) int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.calls = append(ft.calls, state)
+
+	count := 0
+	for _, call := range ft.calls {
+		if call == state {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestLocalExecutor_StartExecution(t *testing.T) {
+
+	unauthorized := &bk.UnauthorizedError{APIError: &bk.APIError{StatusCode: 401}}
+
+	tests := []struct {
+		name           string
+		tasks          *fakeTasks
+		wantCalls      []string
+		wantStatus     string
+		wantTaskStatus string
+		wantTaskError  *bk.TaskError
+	}{
+		{
+			name:           "StartExecution() with build which succeeds",
+			tasks:          &fakeTasks{},
+			wantCalls:      []string{SubmitJobState, CheckJobState, CheckJobState, CompleteJobState},
+			wantStatus:     sfn.ExecutionStatusSucceeded,
+			wantTaskStatus: launcher.TaskSucceeded,
+		},
+		{
+			name:           "StartExecution() with submit error which is retried",
+			tasks:          &fakeTasks{submitErrs: []error{errors.New("throttled")}},
+			wantCalls:      []string{SubmitJobState, SubmitJobState, CheckJobState, CheckJobState, CompleteJobState},
+			wantStatus:     sfn.ExecutionStatusSucceeded,
+			wantTaskStatus: launcher.TaskSucceeded,
+		},
+		{
+			name:          "StartExecution() with submit error which isn't retried",
+			tasks:         &fakeTasks{submitErrs: []error{errors.Wrap(unauthorized, "failed to start job")}},
+			wantCalls:     []string{SubmitJobState, CompleteJobState},
+			wantStatus:    sfn.ExecutionStatusSucceeded,
+			wantTaskError: &bk.TaskError{Error: "UnauthorizedError", Cause: SubmitJobState + " failed: failed to start job: " + unauthorized.Error()},
+		},
+		{
+			name:           "StartExecution() with complete error",
+			tasks:          &fakeTasks{completeErr: unauthorized},
+			wantCalls:      []string{SubmitJobState, CheckJobState, CheckJobState, CompleteJobState},
+			wantStatus:     sfn.ExecutionStatusFailed,
+			wantTaskStatus: launcher.TaskSucceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			le := NewLocalExecutor(tt.tasks.tasks(), time.Millisecond)
+			le.retryUnit = time.Millisecond
+
+			data, err := json.Marshal(&bk.WorkflowData{Job: &api.Job{ID: "abc123"}, AgentName: agentName})
+			require.Nil(t, err)
+
+			require.Nil(t, le.StartExecution(agentName, &api.Job{ID: "abc123"}, data))
+
+			// the job already has an execution
+			require.Nil(t, le.StartExecution(agentName, &api.Job{ID: "abc123"}, data))
+
+			le.Wait()
+
+			require.Equal(t, tt.wantCalls, tt.tasks.calls)
+			require.Equal(t, tt.wantTaskStatus, tt.tasks.completeStatus)
+			require.Equal(t, tt.wantTaskError, tt.tasks.completeError)
+
+			execution, err := le.FindByJobID("abc123")
+			require.Nil(t, err)
+			require.Equal(t, tt.wantStatus, aws.StringValue(execution.Status))
+			require.Equal(t, "arn:aws:states:local:000000000000:execution:CodebuildJobMonitor:job-abc123", aws.StringValue(execution.ExecutionArn))
+
+			running, err := le.RunningForAgent(agentName)
+			require.Nil(t, err)
+			require.Equal(t, 0, running)
+		})
+	}
+}
+
+func TestLocalExecutor_StartExecution_InvalidData(t *testing.T) {
+
+	le := NewLocalExecutor((&fakeTasks{}).tasks(), time.Millisecond)
+
+	err := le.StartExecution(agentName, &api.Job{ID: "abc123"}, []byte("{"))
+	require.Error(t, err)
+
+	execution, err := le.FindByJobID("abc123")
+	require.Nil(t, err)
+	require.Nil(t, execution)
+}
+
+func TestLocalExecutor_StopExecution(t *testing.T) {
+
+	tasks := &fakeTasks{checkStatus: launcher.TaskRunning, checked: make(chan struct{})}
+
+	le := NewLocalExecutor(tasks.tasks(), time.Millisecond)
+
+	data, err := json.Marshal(&bk.WorkflowData{Job: &api.Job{ID: "abc123"}, AgentName: agentName})
+	require.Nil(t, err)
+
+	require.Nil(t, le.StartExecution(agentName, &api.Job{ID: "abc123"}, data))
+
+	<-tasks.checked
+
+	running, err := le.RunningForAgent(agentName)
+	require.Nil(t, err)
+	require.Equal(t, 1, running)
+
+	execution, err := le.FindByJobID("abc123")
+	require.Nil(t, err)
+
+	// the next check is blocked until the execution is stopped
+	require.Nil(t, le.StopExecution(aws.StringValue(execution.ExecutionArn), "job cancelled"))
+
+	le.Wait()
+
+	execution, err = le.FindByJobID("abc123")
+	require.Nil(t, err)
+	require.Equal(t, sfn.ExecutionStatusAborted, aws.StringValue(execution.Status))
+	require.NotContains(t, tasks.calls, CompleteJobState)
+
+	data, err = le.GetExecutionData(aws.StringValue(execution.ExecutionArn))
+	require.Nil(t, err)
+
+	evt := new(bk.WorkflowData)
+	require.Nil(t, json.Unmarshal(data, evt))
+	require.Equal(t, launcher.TaskRunning, evt.TaskStatus)
+
+	require.EqualError(t, le.StopExecution("unknown", "job cancelled"), "execution doesn't exist: unknown")
+}
+
+func TestLocalExecutor_Evict(t *testing.T) {
+
+	defer func(now func() time.Time) { nowFunc = now }(nowFunc)
+	nowFunc = time.Now
+
+	le := NewLocalExecutor((&fakeTasks{}).tasks(), time.Millisecond)
+
+	data, err := json.Marshal(&bk.WorkflowData{Job: &api.Job{ID: "abc123"}, AgentName: agentName})
+	require.Nil(t, err)
+
+	require.Nil(t, le.StartExecution(agentName, &api.Job{ID: "abc123"}, data))
+
+	le.Wait()
+
+	// recently finished executions are kept
+	_, err = le.RunningForAgent(agentName)
+	require.Nil(t, err)
+
+	execution, err := le.FindByJobID("abc123")
+	require.Nil(t, err)
+	require.Equal(t, sfn.ExecutionStatusSucceeded, aws.StringValue(execution.Status))
+
+	nowFunc = func() time.Time { return time.Now().Add(localRetention + time.Minute) }
+
+	_, err = le.RunningForAgent(agentName)
+	require.Nil(t, err)
+
+	execution, err = le.FindByJobID("abc123")
+	require.Nil(t, err)
+	require.Nil(t, execution)
+	require.Empty(t, le.executions)
+}
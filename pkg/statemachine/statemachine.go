@@ -1,11 +1,11 @@
 package statemachine
 
 import (
-	"fmt"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
@@ -13,11 +13,15 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
 
-// MaxPipelineSlugLength Maximum characters to take from the pipeline slug value before it is truncated
-const MaxPipelineSlugLength = 32
-const MaxAgentNameLength = 28
+// executionPrefix executions are named using the buildkite job id with this prefix
+const executionPrefix = "job-"
+
+// startingGracePeriod jobs are indexed before their execution starts, so recently indexed jobs aren't considered stale
+// until their execution has had time to start
+const startingGracePeriod = time.Minute
 
 // used to inject a static time for testing
 var nowFunc = time.Now
@@ -26,82 +30,276 @@ var nowFunc = time.Now
 type Executor interface {
 	RunningForAgent(agentName string) (int, error)
 	StartExecution(agentName string, job *api.Job, jsonData []byte) error
+	ReconcileRunning() (int, error)
+	GetExecutionData(executionArn string) ([]byte, error)
+	StopExecution(executionArn, cause string) error
+	FindByJobID(jobID string) (*sfn.ExecutionListItem, error)
 }
 
 // SFNExecutor run jobs in step functions
 type SFNExecutor struct {
-	cfg    *config.Config
-	sfnSvc sfniface.SFNAPI
+	cfg        *config.Config
+	sfnSvc     sfniface.SFNAPI
+	agentStore store.AgentsAPI
 }
 
 // NewSFNExecutor create a new step function executor
 func NewSFNExecutor(cfg *config.Config, sess *session.Session) *SFNExecutor {
 	sfnSvc := sfn.New(sess)
 	return &SFNExecutor{
-		cfg:    cfg,
-		sfnSvc: sfnSvc,
+		cfg:        cfg,
+		sfnSvc:     sfnSvc,
+		agentStore: store.NewAgents(cfg),
 	}
 }
 
-// RunningForAgent can we run anymore jobs for a given agent with a max of 1 concurrent job per agent
+// RunningForAgent return the number of running jobs for a given agent using the running job index
 func (sfne *SFNExecutor) RunningForAgent(agentName string) (int, error) {
 
-	listResult, err := sfne.sfnSvc.ListExecutions(&sfn.ListExecutionsInput{
-		StateMachineArn: aws.String(sfne.cfg.SfnCodebuildJobMonitorArn),
-		StatusFilter:    aws.String(sfn.ExecutionStatusRunning),
+	jobs, err := sfne.agentStore.ListRunningJobs(agentName)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list running jobs")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"agent":     len(jobs),
+		"agentName": agentName,
+	}).Info("Running jobs")
+
+	return len(jobs), nil
+}
+
+// StartExecution start a step function execution named after the job, if the job already has an execution, for
+// example when accepting the job is retried, the existing execution is used and is only added to the running job
+// index while it is running
+func (sfne *SFNExecutor) StartExecution(agentName string, job *api.Job, jsonData []byte) error {
+
+	execName := executionName(job.ID)
+	execArn := executionArn(sfne.cfg.SfnCodebuildJobMonitorArn, execName)
+
+	// the job is indexed before the execution starts so the index entry can't be written after a short execution has
+	// already removed it
+	err := sfne.agentStore.AddRunningJob(&store.RunningJob{
+		AgentName:    agentName,
+		JobID:        job.ID,
+		ExecutionArn: execArn,
+		Started:      nowFunc(),
 	})
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to locate step function")
+		return errors.Wrap(err, "failed to add running job")
 	}
 
-	i := 0
+	execResult, err := sfne.sfnSvc.StartExecution(&sfn.StartExecutionInput{
+		StateMachineArn: aws.String(sfne.cfg.SfnCodebuildJobMonitorArn),
+		Input:           aws.String(string(jsonData)),
+		Name:            aws.String(execName),
+	})
+	switch {
+	case isAWSError(err, sfn.ErrCodeExecutionAlreadyExists):
+		res, err := sfne.sfnSvc.DescribeExecution(&sfn.DescribeExecutionInput{
+			ExecutionArn: aws.String(execArn),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to describe execution")
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"ID":           job.ID,
+			"Name":         execName,
+			"ExecutionArn": execArn,
+			"Status":       aws.StringValue(res.Status),
+		}).Warn("execution already exists")
 
-	for _, exec := range listResult.Executions {
-		if strings.Contains(aws.StringValue(exec.Name), agentName) {
-			i++
+		// a finished execution has already removed the job from the running job index
+		if aws.StringValue(res.Status) != sfn.ExecutionStatusRunning {
+			return sfne.removeRunningJob(agentName, job.ID)
 		}
+	case err != nil:
+		removeErr := sfne.removeRunningJob(agentName, job.ID)
+		if removeErr != nil {
+			logrus.WithError(removeErr).WithField("ID", job.ID).Error("failed to remove running job after the execution failed to start")
+		}
+
+		return errors.Wrap(err, "failed to exec step function")
+	default:
+		logrus.WithFields(logrus.Fields{
+			"ID":           job.ID,
+			"Name":         execName,
+			"ExecutionArn": aws.StringValue(execResult.ExecutionArn),
+		}).Info("started execution")
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"total":     len(listResult.Executions),
-		"agent":     i,
-		"agentName": agentName,
-	}).Info("Running executions")
+	return nil
+}
+
+func (sfne *SFNExecutor) removeRunningJob(agentName, jobID string) error {
 
-	return i, nil
+	err := sfne.agentStore.RemoveRunningJob(agentName, jobID)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove running job")
+	}
+
+	return nil
 }
 
-// StartExecution start a step function execution
-func (sfne *SFNExecutor) StartExecution(agentName string, job *api.Job, jsonData []byte) error {
+// GetExecutionData return the workflow data from the most recent state the execution exited, or the execution
+// input if it hasn't completed a state yet
+func (sfne *SFNExecutor) GetExecutionData(executionArn string) ([]byte, error) {
 
-	pipelineSlug := job.Env["BUILDKITE_PIPELINE_SLUG"]
+	var data *string
 
-	// truncate the pipeline slug if longer than MaxPipelineSlugLength
-	if len(pipelineSlug) > MaxPipelineSlugLength {
-		pipelineSlug = pipelineSlug[0:MaxPipelineSlugLength]
+	err := sfne.sfnSvc.GetExecutionHistoryPages(&sfn.GetExecutionHistoryInput{
+		ExecutionArn: aws.String(executionArn),
+		ReverseOrder: aws.Bool(true),
+	}, func(page *sfn.GetExecutionHistoryOutput, lastPage bool) bool {
+		for _, event := range page.Events {
+			switch {
+			case event.StateExitedEventDetails != nil:
+				data = event.StateExitedEventDetails.Output
+			case event.ExecutionStartedEventDetails != nil:
+				data = event.ExecutionStartedEventDetails.Input
+			default:
+				continue
+			}
+
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get execution history")
 	}
 
-	// truncate the agent name if longer than MaxAgentNameLength
-	if len(agentName) > MaxAgentNameLength {
-		agentName = agentName[0:MaxAgentNameLength]
+	if data == nil {
+		return nil, errors.Errorf("no data found in execution history: %s", executionArn)
 	}
 
-	execName := fmt.Sprintf("%s_%s_%s", pipelineSlug, agentName, nowFunc().Format("2006-01-02T150405Z"))
+	return []byte(aws.StringValue(data)), nil
+}
 
-	execResult, err := sfne.sfnSvc.StartExecution(&sfn.StartExecutionInput{
+// StopExecution stop a running step function execution
+func (sfne *SFNExecutor) StopExecution(executionArn, cause string) error {
+
+	_, err := sfne.sfnSvc.StopExecution(&sfn.StopExecutionInput{
+		ExecutionArn: aws.String(executionArn),
+		Cause:        aws.String(cause),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to stop execution")
+	}
+
+	return nil
+}
+
+// ReconcileRunning remove jobs from the running job index which no longer have a running execution, these are
+// left behind when an execution fails before completing the job. Returns the number of jobs removed.
+func (sfne *SFNExecutor) ReconcileRunning() (int, error) {
+
+	// read the index first so jobs added after this point are never considered stale
+	jobs, err := sfne.agentStore.ListRunningJobs("")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list running jobs")
+	}
+
+	running := map[string]bool{}
+
+	err = sfne.sfnSvc.ListExecutionsPages(&sfn.ListExecutionsInput{
 		StateMachineArn: aws.String(sfne.cfg.SfnCodebuildJobMonitorArn),
-		Input:           aws.String(string(jsonData)),
-		Name:            aws.String(execName),
+		StatusFilter:    aws.String(sfn.ExecutionStatusRunning),
+	}, func(page *sfn.ListExecutionsOutput, lastPage bool) bool {
+		for _, exec := range page.Executions {
+			running[aws.StringValue(exec.ExecutionArn)] = true
+		}
+		return true
 	})
 	if err != nil {
-		return errors.Wrap(err, "failed to exec step function")
+		return 0, errors.Wrap(err, "failed to list executions")
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"ID":           job.ID,
-		"Name":         execName,
-		"ExecutionArn": aws.StringValue(execResult.ExecutionArn),
-	}).Info("started execution")
+	removed := 0
 
-	return nil
+	for _, job := range jobs {
+		if running[job.ExecutionArn] || nowFunc().Sub(job.Started) < startingGracePeriod {
+			continue
+		}
+
+		err := sfne.agentStore.RemoveRunningJob(job.AgentName, job.JobID)
+		if err != nil {
+			return removed, errors.Wrap(err, "failed to remove running job")
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"agentName":    job.AgentName,
+			"ID":           job.JobID,
+			"ExecutionArn": job.ExecutionArn,
+		}).Info("removed stale running job")
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// FindByJobID find the execution tracking the buildkite job, this returns nil if the job doesn't have an execution.
+// Executions started before they were named after the job are found using the running job index.
+func (sfne *SFNExecutor) FindByJobID(jobID string) (*sfn.ExecutionListItem, error) {
+
+	execArn := executionArn(sfne.cfg.SfnCodebuildJobMonitorArn, executionName(jobID))
+
+	res, err := sfne.sfnSvc.DescribeExecution(&sfn.DescribeExecutionInput{
+		ExecutionArn: aws.String(execArn),
+	})
+	switch {
+	case isAWSError(err, sfn.ErrCodeExecutionDoesNotExist):
+		return sfne.findRunningByJobID(jobID)
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to describe execution")
+	}
+
+	return &sfn.ExecutionListItem{
+		ExecutionArn:    res.ExecutionArn,
+		Name:            res.Name,
+		StateMachineArn: res.StateMachineArn,
+		Status:          res.Status,
+		StartDate:       res.StartDate,
+		StopDate:        res.StopDate,
+	}, nil
+}
+
+func (sfne *SFNExecutor) findRunningByJobID(jobID string) (*sfn.ExecutionListItem, error) {
+
+	jobs, err := sfne.agentStore.ListRunningJobs("")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list running jobs")
+	}
+
+	for _, job := range jobs {
+		if job.JobID != jobID {
+			continue
+		}
+
+		return &sfn.ExecutionListItem{
+			ExecutionArn:    aws.String(job.ExecutionArn),
+			StateMachineArn: aws.String(sfne.cfg.SfnCodebuildJobMonitorArn),
+			Status:          aws.String(sfn.ExecutionStatusRunning),
+			StartDate:       aws.Time(job.Started),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// executionName name the execution after the buildkite job, job ids are unique so a job can only have one execution
+func executionName(jobID string) string {
+	return executionPrefix + jobID
+}
+
+// executionArn the arn of the named execution of the state machine
+func executionArn(stateMachineArn, name string) string {
+	return strings.Replace(stateMachineArn, ":stateMachine:", ":execution:", 1) + ":" + name
+}
+
+func isAWSError(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
 }
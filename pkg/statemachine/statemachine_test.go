@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.com/buildkite/agent/api"
 	"github.com/pkg/errors"
@@ -12,13 +13,14 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/wolfeidau/buildkite-serverless-agent/mocks"
 	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/store"
 )
 
 var (
 	cfg = &config.Config{
 		EnvironmentName:           "dev",
 		EnvironmentNumber:         "1",
-		SfnCodebuildJobMonitorArn: "test",
+		SfnCodebuildJobMonitorArn: "arn:aws:states:us-east-1:123456789012:stateMachine:CodebuildJobMonitor-dev-1",
 	}
 
 	agentName = "test-agent-dev-1"
@@ -31,34 +33,29 @@ func TestSFNExecutor_RunningForAgent(t *testing.T) {
 	type args struct {
 		agentName string
 	}
-	type sfnMock struct {
+	type storeMock struct {
 		method          string
 		arguments       []interface{}
 		returnArguments []interface{}
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		sfnMock sfnMock
-		args    args
-		want    int
-		wantErr bool
+		name      string
+		fields    fields
+		storeMock storeMock
+		args      args
+		want      int
+		wantErr   bool
 	}{
 		{
 			name:   "RunningForAgent() with valid agent",
 			fields: fields{cfg: cfg},
 			args:   args{agentName},
-			sfnMock: sfnMock{
-				method:    "ListExecutions",
-				arguments: []interface{}{mock.Anything},
+			storeMock: storeMock{
+				method:    "ListRunningJobs",
+				arguments: []interface{}{agentName},
 				returnArguments: []interface{}{
-					&sfn.ListExecutionsOutput{
-						Executions: []*sfn.ExecutionListItem{
-							&sfn.ExecutionListItem{
-								ExecutionArn: aws.String("test"),
-								Name:         aws.String("test_test-agent-dev-1_test"),
-							},
-						},
+					[]*store.RunningJob{
+						&store.RunningJob{AgentName: agentName, JobID: "abc123", ExecutionArn: "test"},
 					},
 					nil,
 				},
@@ -67,12 +64,12 @@ func TestSFNExecutor_RunningForAgent(t *testing.T) {
 			wantErr: false,
 		},
 		{
-			name:   "RunningForAgent() with aws api failure",
+			name:   "RunningForAgent() with store failure",
 			fields: fields{cfg: cfg},
 			args:   args{agentName},
-			sfnMock: sfnMock{
-				method:    "ListExecutions",
-				arguments: []interface{}{mock.Anything},
+			storeMock: storeMock{
+				method:    "ListRunningJobs",
+				arguments: []interface{}{agentName},
 				returnArguments: []interface{}{
 					nil, errors.New("woops"),
 				},
@@ -84,20 +81,18 @@ func TestSFNExecutor_RunningForAgent(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			sfnSvc := &mocks.SFNAPI{}
+			agentStore := &mocks.AgentsAPI{}
 
 			sfne := &SFNExecutor{
-				cfg:    tt.fields.cfg,
-				sfnSvc: sfnSvc,
+				cfg:        tt.fields.cfg,
+				sfnSvc:     &mocks.SFNAPI{},
+				agentStore: agentStore,
 			}
 
-			sfnSvc.On(tt.sfnMock.method, tt.sfnMock.arguments...).Return(tt.sfnMock.returnArguments...)
+			agentStore.On(tt.storeMock.method, tt.storeMock.arguments...).Return(tt.storeMock.returnArguments...)
 
 			got, err := sfne.RunningForAgent(tt.args.agentName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("SFNExecutor.RunningForAgent() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
+			require.Equal(t, tt.wantErr, err != nil)
 			require.Equal(t, tt.want, got)
 		})
 	}
@@ -110,6 +105,8 @@ func TestSFNExecutor_StartExecution(t *testing.T) {
 		return dt
 	}
 
+	execArn := "arn:aws:states:us-east-1:123456789012:execution:CodebuildJobMonitor-dev-1:job-abc123"
+
 	type fields struct {
 		cfg *config.Config
 	}
@@ -124,50 +121,86 @@ func TestSFNExecutor_StartExecution(t *testing.T) {
 		returnArguments []interface{}
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		sfnMock sfnMock
-		wantErr bool
+		name           string
+		fields         fields
+		args           args
+		sfnMock        sfnMock
+		describeStatus string // status of the existing execution
+		addErr         error
+		wantStarted    bool
+		wantRemoved    bool
+		wantErr        bool
 	}{
 		{
-			name:   "RunningForAgent() with valid job",
+			name:   "StartExecution() with valid job",
 			fields: fields{cfg: cfg},
 			args: args{
 				agentName: agentName,
-				job: &api.Job{
-					Env: map[string]string{
-						"BUILDKITE_PIPELINE_SLUG": "testingtestingtestingtestingtestingtestingtestingtestingtestingtesting",
-					},
-				},
-				jsonData: []byte{},
+				job:       &api.Job{ID: "abc123"},
+				jsonData:  []byte{},
 			},
 			sfnMock: sfnMock{
-				method:    "StartExecution",
+				method: "StartExecution",
 				arguments: []interface{}{&sfn.StartExecutionInput{
-					Input: aws.String(""),
-					Name: aws.String("testingtestingtestingtestingtest_test-agent-dev-1_" + nowFunc().Format("2006-01-02T150405Z")),
-					StateMachineArn: aws.String("test"),
+					Input:           aws.String(""),
+					Name:            aws.String("job-abc123"),
+					StateMachineArn: aws.String(cfg.SfnCodebuildJobMonitorArn),
 				}},
 				returnArguments: []interface{}{
 					&sfn.StartExecutionOutput{
-						ExecutionArn: aws.String("test"),
+						ExecutionArn: aws.String(execArn),
 					},
 					nil,
 				},
 			},
+			wantStarted: true,
 		},
 		{
-			name:   "RunningForAgent() with aws api failure",
+			name:   "StartExecution() with existing execution",
 			fields: fields{cfg: cfg},
 			args: args{
 				agentName: agentName,
-				job: &api.Job{
-					Env: map[string]string{
-						"BUILDKITE_PIPELINE_SLUG": "testingtestingtestingtestingtestingtestingtestingtestingtestingtesting",
-					},
+				job:       &api.Job{ID: "abc123"},
+				jsonData:  []byte{},
+			},
+			sfnMock: sfnMock{
+				method:    "StartExecution",
+				arguments: []interface{}{mock.Anything},
+				returnArguments: []interface{}{
+					nil,
+					awserr.New(sfn.ErrCodeExecutionAlreadyExists, "Execution Already Exists", nil),
 				},
-				jsonData: []byte{},
+			},
+			describeStatus: sfn.ExecutionStatusRunning,
+			wantStarted:    true,
+		},
+		{
+			name:   "StartExecution() with existing execution which has finished",
+			fields: fields{cfg: cfg},
+			args: args{
+				agentName: agentName,
+				job:       &api.Job{ID: "abc123"},
+				jsonData:  []byte{},
+			},
+			sfnMock: sfnMock{
+				method:    "StartExecution",
+				arguments: []interface{}{mock.Anything},
+				returnArguments: []interface{}{
+					nil,
+					awserr.New(sfn.ErrCodeExecutionAlreadyExists, "Execution Already Exists", nil),
+				},
+			},
+			describeStatus: sfn.ExecutionStatusSucceeded,
+			wantStarted:    true,
+			wantRemoved:    true,
+		},
+		{
+			name:   "StartExecution() with aws api failure",
+			fields: fields{cfg: cfg},
+			args: args{
+				agentName: agentName,
+				job:       &api.Job{ID: "abc123"},
+				jsonData:  []byte{},
 			},
 			sfnMock: sfnMock{
 				method:    "StartExecution",
@@ -177,6 +210,24 @@ func TestSFNExecutor_StartExecution(t *testing.T) {
 					errors.New("woops"),
 				},
 			},
+			wantStarted: true,
+			wantRemoved: true,
+			wantErr:     true,
+		},
+		{
+			name:   "StartExecution() with running job index failure",
+			fields: fields{cfg: cfg},
+			args: args{
+				agentName: agentName,
+				job:       &api.Job{ID: "abc123"},
+				jsonData:  []byte{},
+			},
+			sfnMock: sfnMock{
+				method:          "StartExecution",
+				arguments:       []interface{}{mock.Anything},
+				returnArguments: []interface{}{&sfn.StartExecutionOutput{ExecutionArn: aws.String(execArn)}, nil},
+			},
+			addErr:  errors.New("woops"),
 			wantErr: true,
 		},
 	}
@@ -184,17 +235,177 @@ func TestSFNExecutor_StartExecution(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 
 			sfnSvc := &mocks.SFNAPI{}
+			agentStore := &mocks.AgentsAPI{}
 
 			sfne := &SFNExecutor{
-				cfg:    tt.fields.cfg,
-				sfnSvc: sfnSvc,
+				cfg:        tt.fields.cfg,
+				sfnSvc:     sfnSvc,
+				agentStore: agentStore,
 			}
 
 			sfnSvc.On(tt.sfnMock.method, tt.sfnMock.arguments...).Return(tt.sfnMock.returnArguments...)
+			sfnSvc.On("DescribeExecution", &sfn.DescribeExecutionInput{ExecutionArn: aws.String(execArn)}).Return(&sfn.DescribeExecutionOutput{
+				ExecutionArn: aws.String(execArn),
+				Status:       aws.String(tt.describeStatus),
+			}, nil)
+			agentStore.On("AddRunningJob", &store.RunningJob{
+				AgentName:    tt.args.agentName,
+				JobID:        "abc123",
+				ExecutionArn: execArn,
+				Started:      nowFunc(),
+			}).Return(tt.addErr)
+			agentStore.On("RemoveRunningJob", tt.args.agentName, "abc123").Return(nil)
 
-			if err := sfne.StartExecution(tt.args.agentName, tt.args.job, tt.args.jsonData); (err != nil) != tt.wantErr {
-				t.Errorf("SFNExecutor.StartExecution() error = %v, wantErr %v", err, tt.wantErr)
+			err := sfne.StartExecution(tt.args.agentName, tt.args.job, tt.args.jsonData)
+			require.Equal(t, tt.wantErr, err != nil)
+
+			// the job is indexed before the execution is started
+			agentStore.AssertCalled(t, "AddRunningJob", mock.Anything)
+
+			if tt.wantStarted {
+				sfnSvc.AssertCalled(t, "StartExecution", mock.Anything)
+			} else {
+				sfnSvc.AssertNotCalled(t, "StartExecution", mock.Anything)
 			}
+
+			if tt.wantRemoved {
+				agentStore.AssertCalled(t, "RemoveRunningJob", tt.args.agentName, "abc123")
+			} else {
+				agentStore.AssertNotCalled(t, "RemoveRunningJob", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestSFNExecutor_FindByJobID(t *testing.T) {
+
+	started := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	execArn := "arn:aws:states:us-east-1:123456789012:execution:CodebuildJobMonitor-dev-1:job-abc123"
+
+	tests := []struct {
+		name        string
+		jobID       string
+		runningJobs []*store.RunningJob
+		want        *sfn.ExecutionListItem
+	}{
+		{
+			name:  "FindByJobID() with execution named after the job",
+			jobID: "abc123",
+			want: &sfn.ExecutionListItem{
+				ExecutionArn: aws.String(execArn),
+				Name:         aws.String("job-abc123"),
+				Status:       aws.String(sfn.ExecutionStatusRunning),
+				StartDate:    aws.Time(started),
+			},
+		},
+		{
+			name:  "FindByJobID() with execution in the running job index",
+			jobID: "def456",
+			runningJobs: []*store.RunningJob{
+				&store.RunningJob{AgentName: agentName, JobID: "def456", ExecutionArn: "legacy", Started: started},
+			},
+			want: &sfn.ExecutionListItem{
+				ExecutionArn:    aws.String("legacy"),
+				StateMachineArn: aws.String(cfg.SfnCodebuildJobMonitorArn),
+				Status:          aws.String(sfn.ExecutionStatusRunning),
+				StartDate:       aws.Time(started),
+			},
+		},
+		{
+			name:  "FindByJobID() with no execution",
+			jobID: "def456",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sfnSvc := &mocks.SFNAPI{}
+			agentStore := &mocks.AgentsAPI{}
+
+			sfne := &SFNExecutor{
+				cfg:        cfg,
+				sfnSvc:     sfnSvc,
+				agentStore: agentStore,
+			}
+
+			sfnSvc.On("DescribeExecution", &sfn.DescribeExecutionInput{ExecutionArn: aws.String(execArn)}).Return(&sfn.DescribeExecutionOutput{
+				ExecutionArn: aws.String(execArn),
+				Name:         aws.String("job-abc123"),
+				Status:       aws.String(sfn.ExecutionStatusRunning),
+				StartDate:    aws.Time(started),
+			}, nil)
+			sfnSvc.On("DescribeExecution", mock.Anything).Return(nil, awserr.New(sfn.ErrCodeExecutionDoesNotExist, "Execution Does Not Exist", nil))
+			agentStore.On("ListRunningJobs", "").Return(tt.runningJobs, nil)
+
+			got, err := sfne.FindByJobID(tt.jobID)
+			require.Nil(t, err)
+			require.Equal(t, tt.want, got)
 		})
 	}
 }
+
+func TestSFNExecutor_ReconcileRunning(t *testing.T) {
+
+	sfnSvc := &mocks.SFNAPI{}
+	agentStore := &mocks.AgentsAPI{}
+
+	sfne := &SFNExecutor{
+		cfg:        cfg,
+		sfnSvc:     sfnSvc,
+		agentStore: agentStore,
+	}
+
+	agentStore.On("ListRunningJobs", "").Return([]*store.RunningJob{
+		&store.RunningJob{AgentName: agentName, JobID: "abc123", ExecutionArn: "running"},
+		&store.RunningJob{AgentName: agentName, JobID: "def456", ExecutionArn: "stale"},
+		&store.RunningJob{AgentName: agentName, JobID: "ghi789", ExecutionArn: "starting", Started: nowFunc()},
+	}, nil)
+	agentStore.On("RemoveRunningJob", agentName, "def456").Return(nil)
+
+	sfnSvc.On("ListExecutionsPages", mock.AnythingOfType("*sfn.ListExecutionsInput"), mock.Anything).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*sfn.ListExecutionsOutput, bool) bool)
+		fn(&sfn.ListExecutionsOutput{
+			Executions: []*sfn.ExecutionListItem{
+				&sfn.ExecutionListItem{ExecutionArn: aws.String("running")},
+			},
+		}, true)
+	}).Return(nil)
+
+	removed, err := sfne.ReconcileRunning()
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	agentStore.AssertExpectations(t)
+	agentStore.AssertNotCalled(t, "RemoveRunningJob", agentName, "ghi789")
+}
+
+func TestSFNExecutor_GetExecutionData(t *testing.T) {
+
+	sfnSvc := &mocks.SFNAPI{}
+
+	sfne := &SFNExecutor{
+		cfg:    cfg,
+		sfnSvc: sfnSvc,
+	}
+
+	sfnSvc.On("GetExecutionHistoryPages", mock.AnythingOfType("*sfn.GetExecutionHistoryInput"), mock.Anything).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*sfn.GetExecutionHistoryOutput, bool) bool)
+		fn(&sfn.GetExecutionHistoryOutput{
+			Events: []*sfn.HistoryEvent{
+				&sfn.HistoryEvent{Type: aws.String(sfn.HistoryEventTypeWaitStateEntered)},
+				&sfn.HistoryEvent{
+					Type:                    aws.String(sfn.HistoryEventTypeTaskStateExited),
+					StateExitedEventDetails: &sfn.StateExitedEventDetails{Output: aws.String(`{"wait_time":10}`)},
+				},
+				&sfn.HistoryEvent{
+					Type:                         aws.String(sfn.HistoryEventTypeExecutionStarted),
+					ExecutionStartedEventDetails: &sfn.ExecutionStartedEventDetails{Input: aws.String(`{}`)},
+				},
+			},
+		}, true)
+	}).Return(nil)
+
+	data, err := sfne.GetExecutionData("test")
+	require.Nil(t, err)
+	require.Equal(t, `{"wait_time":10}`, string(data))
+}
@@ -1,6 +1,9 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"strings"
 	"time"
 
@@ -12,19 +15,125 @@ import (
 	"github.com/wolfeidau/dynalock"
 )
 
+// number of times an agent is read and written before giving up on a conflicting update
+const maxUpdateAttempts = 5
+
 const (
 	storePartition = "Agents"
 	agentPrefix    = "/agent/"
 	lockPrefix     = "/locks/"
 )
 
+const (
+	// AgentStateRegistered the agent has been registered with buildkite
+	AgentStateRegistered = "registered"
+
+	// AgentStateConnected the agent has connected to buildkite and is polling for jobs
+	AgentStateConnected = "connected"
+
+	// AgentStatePaused the agent has been paused by buildkite and won't accept jobs
+	AgentStatePaused = "paused"
+
+	// AgentStateDisconnected the agent has been disconnected from buildkite
+	AgentStateDisconnected = "disconnected"
+)
+
 // AgentRecord stores the details of the agent
 type AgentRecord struct {
-	Name             string     `json:"name,omitempty"`
-	Tags             []string   `json:"tags,omitempty"`
-	CodebuildProject string     `json:"codebuild_project,omitempty"`
-	Modified         time.Time  `json:"modified,omitempty"`
-	AgentConfig      *api.Agent `json:"agent_config,omitempty"`
+	Name                    string     `json:"name,omitempty"`
+	Tags                    []string   `json:"tags,omitempty"`
+	CodebuildProject        string     `json:"codebuild_project,omitempty"`
+	Modified                time.Time  `json:"modified,omitempty"`
+	AgentConfig             *api.Agent `json:"agent_config,omitempty"`
+	PreviousAgentConfig     *api.Agent `json:"previous_agent_config,omitempty"`      // replaced agent config kept until the jobs it accepted complete
+	Registered              time.Time  `json:"registered,omitempty"`                 // when the access token was issued by buildkite
+	RotateTokensBefore      time.Time  `json:"rotate_tokens_before,omitempty"`       // access tokens issued before this are rotated
+	RegisteredTags          []string   `json:"registered_tags,omitempty"`            // tags sent to buildkite when the agent was registered
+	Priority                string     `json:"priority,omitempty"`                   // agents with a higher priority are assigned jobs first
+	RegisteredPriority      string     `json:"registered_priority,omitempty"`        // priority sent to buildkite when the agent was registered
+	AgentKeyParam           string     `json:"agent_key_param,omitempty"`            // ssm parameter holding the registration token, defaults to the stack wide key
+	RegisteredAgentKeyParam string     `json:"registered_agent_key_param,omitempty"` // ssm parameter used when the agent was registered
+	Disabled                bool       `json:"disabled,omitempty"`                   // disabled agents are disconnected from buildkite
+	Enabled                 time.Time  `json:"enabled,omitempty"`                    // replicas disconnected before the agent was enabled are registered again
+	Removed                 bool       `json:"removed,omitempty"`                    // removed agents are disconnected then deleted
+	State                   string     `json:"state,omitempty"`
+	StateUpdated            time.Time  `json:"state_updated,omitempty"`
+	MaxConcurrentJobs       int        `json:"max_concurrent_jobs,omitempty"` // number of buildkite agents registered for this record
+	Parent                  string     `json:"parent,omitempty"`              // name of the agent this record is a replica of
+	Replica                 int        `json:"replica,omitempty"`
+}
+
+// ReplicaName return the name of a replica of the named agent
+func ReplicaName(name string, replica int) string {
+	return fmt.Sprintf("%s-%d", name, replica)
+}
+
+// UpdateState record a transition in the lifecycle of the agent
+func (ar *AgentRecord) UpdateState(state string) {
+	ar.State = state
+	ar.StateUpdated = time.Now()
+}
+
+// Active is the agent enabled and not removed
+func (ar *AgentRecord) Active() bool {
+	return !ar.Disabled && !ar.Removed
+}
+
+// Connected is the agent connected to buildkite, this includes paused agents
+func (ar *AgentRecord) Connected() bool {
+	return ar.State == AgentStateConnected || ar.State == AgentStatePaused
+}
+
+// TokenExpired should the access token be rotated, either a rotation was requested after it was issued or it is older
+// than the max age, a max age of zero disables expiry. Tokens issued before the registration time was recorded are
+// treated as expired once a max age is set.
+func (ar *AgentRecord) TokenExpired(maxAge time.Duration) bool {
+	if ar.AgentConfig == nil {
+		return false
+	}
+
+	if ar.Registered.Before(ar.RotateTokensBefore) {
+		return true
+	}
+
+	return maxAge > 0 && (ar.Registered.IsZero() || time.Since(ar.Registered) > maxAge)
+}
+
+// AgentConfigFor return the agent config holding the access token identified by the token id, jobs accepted before
+// the token was rotated use the previous agent config. Jobs with a token id which doesn't match the current config,
+// including those accepted before token ids were recorded, also use the previous agent config while it is kept as it
+// is only kept for the job accepted with the old token.
+func (ar *AgentRecord) AgentConfigFor(tokenID string) *api.Agent {
+	if ar.PreviousAgentConfig == nil {
+		return ar.AgentConfig
+	}
+
+	if ar.AgentConfig != nil && tokenID != "" && TokenID(ar.AgentConfig.AccessToken) == tokenID {
+		return ar.AgentConfig
+	}
+
+	return ar.PreviousAgentConfig
+}
+
+// TokenID identify an access token without exposing it, this is passed to the step functions with each job
+func TokenID(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Enable enable the agent, if it was disconnected it will be registered again with buildkite
+func (ar *AgentRecord) Enable() {
+	ar.Disabled = false
+	ar.Enabled = time.Now()
+	ar.Reconnect()
+}
+
+// Reconnect register the agent again with buildkite if it was disconnected
+func (ar *AgentRecord) Reconnect() {
+	if ar.State == AgentStateDisconnected {
+		ar.RegisteredTags = nil
+		ar.State = ""
+	}
 }
 
 // AgentsAPI agents store API
@@ -32,7 +141,15 @@ type AgentsAPI interface {
 	List() ([]*AgentRecord, error)
 	Get(name string) (*AgentRecord, error)
 	CreateOrUpdate(agent *AgentRecord) (*AgentRecord, error)
+	Create(agent *AgentRecord) error
+	Update(name string, update func(agent *AgentRecord) error) (*AgentRecord, error)
+	Delete(name string) error
 	NewLock(name string, ttl time.Duration) (dynalock.Locker, error)
+	DeleteLock(name string) error
+	AddRunningJob(job *RunningJob) error
+	GetRunningJob(agentName, jobID string) (*RunningJob, error)
+	RemoveRunningJob(agentName, jobID string) error
+	ListRunningJobs(agentName string) ([]*RunningJob, error)
 }
 
 // Agents store all configured agents
@@ -122,6 +239,79 @@ func (ag *Agents) CreateOrUpdate(agent *AgentRecord) (*AgentRecord, error) {
 	return agent, nil
 }
 
+// Create save a new agent, this returns dynalock.ErrKeyExists if the agent has already been saved
+func (ag *Agents) Create(agent *AgentRecord) error {
+
+	agent.Modified = time.Now()
+
+	item, err := dynalock.MarshalStruct(agent)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = ag.kv.AtomicPut(
+		agentPrefix+agent.Name,
+		dynalock.WriteWithAttributeValue(item),
+		dynalock.WriteWithNoExpires(),
+	)
+
+	return err
+}
+
+// Update apply the change to the latest version of the stored agent, the agent is only written if it hasn't been
+// modified since it was read, otherwise it is read again and the change reapplied. This keeps changes made at the
+// same time by the agent pool and the agent-cli. Returns dynalock.ErrKeyNotFound if the agent doesn't exist.
+func (ag *Agents) Update(name string, update func(agent *AgentRecord) error) (*AgentRecord, error) {
+
+	for attempt := 1; ; attempt++ {
+
+		pair, err := ag.kv.Get(agentPrefix + name)
+		if err != nil {
+			return nil, err
+		}
+
+		agent := new(AgentRecord)
+
+		err = dynalock.UnmarshalStruct(pair.AttributeValue(), agent)
+		if err != nil {
+			return nil, err
+		}
+
+		agent.Name = strings.TrimPrefix(agent.Name, agentPrefix)
+
+		err = update(agent)
+		if err != nil {
+			return nil, err
+		}
+
+		agent.Modified = time.Now()
+
+		item, err := dynalock.MarshalStruct(agent)
+		if err != nil {
+			return nil, err
+		}
+
+		_, _, err = ag.kv.AtomicPut(
+			agentPrefix+name,
+			dynalock.WriteWithAttributeValue(item),
+			dynalock.WriteWithNoExpires(),
+			dynalock.WriteWithPreviousKV(pair),
+		)
+		if err == dynalock.ErrKeyModified && attempt < maxUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return agent, nil
+	}
+}
+
+func (ag *Agents) Delete(name string) error {
+	return ag.kv.Delete(agentPrefix + name)
+}
+
 func (ag *Agents) NewLock(name string, ttl time.Duration) (dynalock.Locker, error) {
 
 	renewCh := make(chan struct{})
@@ -133,3 +323,9 @@ func (ag *Agents) NewLock(name string, ttl time.Duration) (dynalock.Locker, erro
 		dynalock.LockWithRenewLock(renewCh),
 	)
 }
+
+// DeleteLock remove the lock on the agent regardless of who holds it, this is only used to clean up a lock which was
+// acquired as the attempt to acquire it was cancelled, as it can no longer be unlocked
+func (ag *Agents) DeleteLock(name string) error {
+	return ag.kv.Delete(lockPrefix + name)
+}
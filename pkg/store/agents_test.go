@@ -0,0 +1,199 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/require"
+	"github.com/wolfeidau/dynalock"
+)
+
+// fakeDynamoDB holds the agent table in memory, only the operations used by conditional writes are implemented
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items        map[string]map[string]*dynamodb.AttributeValue
+	beforeUpdate func() // run once before the next update, tests change the stored agent here
+}
+
+func (fd *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: fd.items[aws.StringValue(input.Key["name"].S)]}, nil
+}
+
+func (fd *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if fd.beforeUpdate != nil {
+		beforeUpdate := fd.beforeUpdate
+		fd.beforeUpdate = nil
+		beforeUpdate()
+	}
+
+	name := aws.StringValue(input.Key["name"].S)
+
+	version := int64(0)
+	if item, ok := fd.items[name]; ok {
+		version, _ = strconv.ParseInt(aws.StringValue(item["version"].N), 10, 64)
+	}
+
+	if input.ConditionExpression != nil && aws.StringValue(input.ExpressionAttributeValues[":lastRevision"].N) != strconv.FormatInt(version, 10) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		"id":      input.Key["id"],
+		"name":    input.Key["name"],
+		"version": {N: aws.String(strconv.FormatInt(version+1, 10))},
+		"payload": input.ExpressionAttributeValues[":payload"],
+	}
+	fd.items[name] = item
+
+	return &dynamodb.UpdateItemOutput{Attributes: item}, nil
+}
+
+func newFakeAgents() (*Agents, *fakeDynamoDB) {
+	fd := &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	return &Agents{kv: dynalock.New(fd, "agents", storePartition)}, fd
+}
+
+func TestAgentRecord_TokenExpired(t *testing.T) {
+
+	agentConfig := &api.Agent{AccessToken: "token123"}
+
+	tests := []struct {
+		name   string
+		agent  *AgentRecord
+		maxAge time.Duration
+		want   bool
+	}{
+		{
+			name:   "TokenExpired() with agent which isn't registered",
+			agent:  &AgentRecord{},
+			maxAge: time.Hour,
+			want:   false,
+		},
+		{
+			name:   "TokenExpired() with token within the max age",
+			agent:  &AgentRecord{AgentConfig: agentConfig, Registered: time.Now().Add(-time.Minute)},
+			maxAge: time.Hour,
+			want:   false,
+		},
+		{
+			name:   "TokenExpired() with token older than the max age",
+			agent:  &AgentRecord{AgentConfig: agentConfig, Registered: time.Now().Add(-2 * time.Hour)},
+			maxAge: time.Hour,
+			want:   true,
+		},
+		{
+			name:   "TokenExpired() with token issued before the registration time was recorded",
+			agent:  &AgentRecord{AgentConfig: agentConfig},
+			maxAge: time.Hour,
+			want:   true,
+		},
+		{
+			name:   "TokenExpired() with token issued before the registration time was recorded and no max age",
+			agent:  &AgentRecord{AgentConfig: agentConfig},
+			maxAge: 0,
+			want:   false,
+		},
+		{
+			name:   "TokenExpired() with rotation requested",
+			agent:  &AgentRecord{AgentConfig: agentConfig, Registered: time.Now().Add(-time.Minute), RotateTokensBefore: time.Now()},
+			maxAge: 0,
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.agent.TokenExpired(tt.maxAge))
+		})
+	}
+}
+
+func TestAgentRecord_AgentConfigFor(t *testing.T) {
+
+	current := &api.Agent{AccessToken: "token456"}
+	previous := &api.Agent{AccessToken: "token123"}
+
+	tests := []struct {
+		name    string
+		agent   *AgentRecord
+		tokenID string
+		want    *api.Agent
+	}{
+		{
+			name:    "AgentConfigFor() with current token",
+			agent:   &AgentRecord{AgentConfig: current, PreviousAgentConfig: previous},
+			tokenID: TokenID("token456"),
+			want:    current,
+		},
+		{
+			name:    "AgentConfigFor() with previous token",
+			agent:   &AgentRecord{AgentConfig: current, PreviousAgentConfig: previous},
+			tokenID: TokenID("token123"),
+			want:    previous,
+		},
+		{
+			name:    "AgentConfigFor() with job accepted before token ids were recorded",
+			agent:   &AgentRecord{AgentConfig: current, PreviousAgentConfig: previous},
+			tokenID: "",
+			want:    previous,
+		},
+		{
+			name:    "AgentConfigFor() with unknown token",
+			agent:   &AgentRecord{AgentConfig: current, PreviousAgentConfig: previous},
+			tokenID: TokenID("token789"),
+			want:    previous,
+		},
+		{
+			name:    "AgentConfigFor() with job accepted before token ids were recorded and no previous token",
+			agent:   &AgentRecord{AgentConfig: current},
+			tokenID: "",
+			want:    current,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.agent.AgentConfigFor(tt.tokenID))
+		})
+	}
+}
+
+func TestAgents_Update(t *testing.T) {
+
+	agents, fd := newFakeAgents()
+
+	require.Nil(t, agents.Create(&AgentRecord{Name: "deployer-dev-1", AgentConfig: &api.Agent{AccessToken: "token123"}}))
+	require.Equal(t, dynalock.ErrKeyExists, agents.Create(&AgentRecord{Name: "deployer-dev-1"}))
+
+	// the agent is disabled with the agent-cli after the poller read it
+	fd.beforeUpdate = func() {
+		_, err := agents.Update("deployer-dev-1", func(agent *AgentRecord) error {
+			agent.Disabled = true
+			return nil
+		})
+		require.Nil(t, err)
+	}
+
+	attempts := 0
+
+	agent, err := agents.Update("deployer-dev-1", func(agent *AgentRecord) error {
+		attempts++
+		agent.AgentConfig = &api.Agent{AccessToken: "token456"}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, "token456", agent.AgentConfig.AccessToken)
+
+	agent, err = agents.Get("deployer-dev-1")
+	require.Nil(t, err)
+	require.Equal(t, "token456", agent.AgentConfig.AccessToken)
+	require.True(t, agent.Disabled)
+
+	_, err = agents.Update("deployer-dev-2", func(agent *AgentRecord) error { return nil })
+	require.Equal(t, dynalock.ErrKeyNotFound, err)
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"time"
+
+	"github.com/wolfeidau/dynalock"
+)
+
+const runningPrefix = "/running/"
+
+// RunningJob an entry in the index of jobs running for each agent
+type RunningJob struct {
+	AgentName    string    `json:"agent_name,omitempty"`
+	JobID        string    `json:"job_id,omitempty"`
+	ExecutionArn string    `json:"execution_arn,omitempty"`
+	Started      time.Time `json:"started,omitempty"`
+}
+
+func (ag *Agents) AddRunningJob(job *RunningJob) error {
+
+	item, err := dynalock.MarshalStruct(job)
+	if err != nil {
+		return err
+	}
+
+	return ag.kv.Put(
+		runningJobKey(job.AgentName, job.JobID),
+		dynalock.WriteWithAttributeValue(item),
+		dynalock.WriteWithNoExpires(),
+	)
+}
+
+// GetRunningJob get a running job for the named agent, this returns nil if the job isn't running
+func (ag *Agents) GetRunningJob(agentName, jobID string) (*RunningJob, error) {
+
+	pair, err := ag.kv.Get(runningJobKey(agentName, jobID))
+	if err != nil {
+		if err == dynalock.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	job := new(RunningJob)
+
+	err = dynalock.UnmarshalStruct(pair.AttributeValue(), job)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (ag *Agents) RemoveRunningJob(agentName, jobID string) error {
+	return ag.kv.Delete(runningJobKey(agentName, jobID))
+}
+
+// ListRunningJobs list the running jobs for the named agent, or all agents if the name is empty
+func (ag *Agents) ListRunningJobs(agentName string) ([]*RunningJob, error) {
+
+	prefix := runningPrefix
+
+	// the trailing slash ensures foo doesn't match jobs for foo-bar
+	if agentName != "" {
+		prefix = runningPrefix + agentName + "/"
+	}
+
+	pairs, err := ag.kv.List(prefix)
+	if err != nil {
+		if err == dynalock.ErrKeyNotFound {
+			return []*RunningJob{}, nil // no running jobs is OK
+		}
+		return nil, err
+	}
+
+	jobs := make([]*RunningJob, len(pairs))
+
+	for n, pair := range pairs {
+
+		job := new(RunningJob)
+
+		err := dynalock.UnmarshalStruct(pair.AttributeValue(), job)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs[n] = job
+	}
+
+	return jobs, nil
+}
+
+func runningJobKey(agentName, jobID string) string {
+	return runningPrefix + agentName + "/" + jobID
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/buildkite/agent/api"
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/buildkite-serverless-agent/pkg/config"
+	"github.com/wolfeidau/dynalock"
+)
+
+const jobPrefix = "/jobs/"
+
+// jobs are expired well after the longest codebuild build timeout so abandoned executions don't leave them behind
+const jobTTL = 7 * 24 * time.Hour
+
+// WorkflowStore stores the buildkite jobs of step function executions, the executions are passed a reference to the
+// job which keeps large jobs and their access tokens out of the execution input and history
+type WorkflowStore interface {
+	SaveJob(ref string, job *api.Job) error
+	GetJob(ref string) (*api.Job, error)
+	DeleteJob(ref string) error
+}
+
+// Workflows store jobs in the agent table
+type Workflows struct {
+	kv dynalock.Store
+}
+
+// NewWorkflows create a new workflow store
+func NewWorkflows(config *config.Config, cfg ...*aws.Config) WorkflowStore {
+	sess := session.Must(session.NewSession(cfg...))
+	kv := dynalock.New(dynamodb.New(sess), config.AgentTableName, storePartition)
+	return &Workflows{
+		kv: kv,
+	}
+}
+
+// SaveJob save the job using the reference, the job is stored as json as the environment can contain empty values
+func (wf *Workflows) SaveJob(ref string, job *api.Job) error {
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal job")
+	}
+
+	return wf.kv.Put(
+		jobPrefix+ref,
+		dynalock.WriteWithBytes(data),
+		dynalock.WriteWithTTL(jobTTL),
+	)
+}
+
+// GetJob get the job saved using the reference
+func (wf *Workflows) GetJob(ref string) (*api.Job, error) {
+
+	pair, err := wf.kv.Get(jobPrefix + ref)
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(api.Job)
+
+	err = json.Unmarshal(pair.BytesValue(), job)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal job")
+	}
+
+	return job, nil
+}
+
+// DeleteJob delete the job saved using the reference
+func (wf *Workflows) DeleteJob(ref string) error {
+	return wf.kv.Delete(jobPrefix + ref)
+}